@@ -2,230 +2,372 @@ package airpin
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"math"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type Airtable struct {
-	token  string
-	client *http.Client
-	base   string
-	period Period
+	token   string
+	client  *http.Client
+	base    string
+	retry   Retry
+	limiter *limiter
+	retries *atomic.Int64
 }
 
-// Mapping from Pinterest Ad Account ID to Airtable Base ID
-var bases = map[string]string{
-	// "5497560xxxxx": "appa7SRvmSAhxxxxx", // TEST
-	// "5497633xxxxx": "appR9q0V06C8xxxxx", // TEST
+// Airtable allows 5 requests per second per base, and when that's exceeded,
+// rejects every request to the base for 30 seconds.
+const (
+	airtableRate    = 5
+	airtablePenalty = 30 * time.Second
+)
+
+// A Base is an Airtable base and the table in it to write to.  When Upsert is
+// set, a row with the same Campaign ID, Start and End as an existing one
+// updates it instead of being appended, so that re-running a period doesn't
+// duplicate its rows.  When AccountFields is set, the rows say which ad
+// account they're from.  Fields renames fields for this table.
+type Base struct {
+	ID            string
+	Table         string
+	Upsert        bool
+	AccountFields bool
+	Fields        map[string]string
+}
+
+func (b Base) path() string {
+	return b.ID + "/" + b.Table
+}
+
+// The path of the table in the API.
+func (b Base) tablePath() string {
+	return b.ID + "/" + url.PathEscape(b.Table)
+}
+
+// The name of the field in this table.
+func (b Base) field(name string) string {
+	if f, ok := b.Fields[name]; ok {
+		return f
+	}
+	return name
+}
+
+// The records with the fields renamed for this table.
+func (b Base) rename(recs []record) []record {
+	if len(b.Fields) == 0 {
+		return recs
+	}
+	out := make([]record, len(recs))
+	for i, r := range recs {
+		fields := make(map[string]any, len(r.Fields))
+		for k, v := range r.Fields {
+			fields[b.field(k)] = v
+		}
+		out[i] = record{r.ID, fields}
+	}
+	return out
 }
 
+// The fields that identify a row when upserting.
+var mergeFields = []string{"Campaign ID", "Start", "End"}
+
 type records struct {
-	Records  [1]record `json:"records"`
-	Typecast bool      `json:"typecast"`
+	Records       []record `json:"records"`
+	Typecast      bool     `json:"typecast"`
+	PerformUpsert *upsert  `json:"performUpsert,omitempty"`
 }
 
-type record struct {
-	ID     string `json:"id,omitempty"`
-	Fields fields `json:"fields,omitempty"`
+type upsert struct {
+	FieldsToMergeOn []string `json:"fieldsToMergeOn"`
 }
 
-type fields struct {
-	ReportDate     string    `json:"Report Date"`
-	Start          string    `json:"Start"`
-	End            string    `json:"End"`
-	CampaignID     string    `json:"Campaign ID"`
-	CampaignName   string    `json:"Campaign Name"`
-	CampaignStatus string    `json:"Campaign Status"`
-	Budget         JSONFloat `json:"Daily budget"`
-	Spend          JSONFloat `json:"Spend"`
-	Reach          JSONFloat `json:"Reach"`
-	Freq           JSONFloat `json:"Freq"`
-	IM             int       `json:"IM"`
-	IM1            int       `json:"IM1"`
-	IM2            int       `json:"IM2"`
-	CPM            JSONFloat `json:"CPM"`
-	PC             int       `json:"PC"`
-	PC1            int       `json:"PC1"`
-	PC2            int       `json:"PC2"`
-	CTR            JSONFloat `json:"CTR"`
-	CPC            JSONFloat `json:"CPC"`
-	SV             int       `json:"SV"`
-	SV1            int       `json:"SV1"`
-	SV2            int       `json:"SV2"`
-	SVR            JSONFloat `json:"SVR"`
-	SVR1           JSONFloat `json:"SVR1"`
-	SVR2           JSONFloat `json:"SVR2"`
-	NGR            JSONFloat `json:"NGR"`
-	NGR1           JSONFloat `json:"NGR1"`
-	NG             int       `json:"NG"`
-	NG1            int       `json:"NG1"`
-	NG2            int       `json:"NG2"`
-	OC             int       `json:"OC"`
-	OC1            int       `json:"OC1"`
-	OC2            int       `json:"OC2"`
-	CTPV           int       `json:"CTPV"`
-	NGPV           int       `json:"NGPV"`
-	VTPV           int       `json:"VTPV"`
-	ATC            int       `json:"ATC"`
-	ATCV           JSONFloat `json:"ATCV"`
-	Checkouts      int       `json:"Checkouts"`
-	CTC            int       `json:"CTC"`
-	NGC            int       `json:"NGC"`
-	VTC            int       `json:"VTC"`
-	Value          JSONFloat `json:"Value"`
-	CTV            JSONFloat `json:"CTV"`
-	NGV            JSONFloat `json:"NGV"`
-	VTV            JSONFloat `json:"VTV"`
-	CPA            JSONFloat `json:"CPA"`
-	ROAS           JSONFloat `json:"ROAS"`
-	Leads          int       `json:"Leads"`
-	CR             JSONFloat `json:"CR"`
-	ConvRate       JSONFloat `json:"Conv Rate"`
-	OCPC           JSONFloat `json:"oCPC"`
+// The most records Airtable accepts in a single request.
+const batchSize = 10
+
+type record struct {
+	ID     string         `json:"id,omitempty"`
+	Fields map[string]any `json:"fields,omitempty"`
 }
 
-func NewAirtable(token string, period Period) *Airtable {
+func NewAirtable(token string, retry Retry) *Airtable {
 	base := "https://api.airtable.com/v0/"
-	return &Airtable{token, &http.Client{}, base, period}
+	return &Airtable{token, &http.Client{}, base, retry, newLimiter(airtableRate), &atomic.Int64{}}
+}
+
+// The number of requests that have been retried.
+func (a Airtable) Retries() int64 {
+	return a.retries.Load()
 }
 
-func (a Airtable) Update(account_id string, rows [][]string) {
-	var start_date, end_date string
-	switch a.period {
-	case Week:
-		start_date = formatDaysAgo(7)
-		end_date = formatDaysAgo(1)
-	case Month:
-		y, m, _ := time.Now().Date()
-		_, m, d := time.Date(y, m, 0, 0, 0, 0, 0, time.UTC).Date()
-		start_date = fmt.Sprintf("%v-%02d-01", y, int(m))
-		end_date = fmt.Sprintf("%v-%02d-%v", y, int(m), d)
+// Map the rows of a report for the dates, with the granularity it was
+// requested with, to Airtable records reported today.  Nothing is written, so
+// that every account can be validated before any of them are.
+func (a Airtable) Records(rows []Row, dates DateRange, granularity string, today time.Time) ([]record, error) {
+	recs := make([]record, 0, len(rows))
+	for _, row := range rows {
+		fields, err := mapping.Values(row)
+		if err != nil {
+			return nil, fmt.Errorf("campaign %s: %w", row["CAMPAIGN_ID"], err)
+		}
+		row_dates, err := row.dates(dates, granularity)
+		if err != nil {
+			return nil, fmt.Errorf("campaign %s: %w", row["CAMPAIGN_ID"], err)
+		}
+		fields["Report Date"] = today.Format(dateLayout)
+		fields["Start"] = row_dates.Start.Format(dateLayout)
+		fields["End"] = row_dates.End.Format(dateLayout)
+		recs = append(recs, record{Fields: fields})
 	}
-	if baseId := bases[account_id]; baseId != "" {
-		for _, row := range rows[1:] {
-			// These metrics are in v4 of the Pinterest API but not v5 so
-			// we have to calculate them here.
-			total_impression := atoi(row[7])
-			total_outbound_click := atoi(row[25]) + atoi(row[26])
-			total_clickthrough := atoi(row[11])
-			click_ratio := float64(total_outbound_click) / float64(total_clickthrough)
-			total_checkout := atoi(row[34])
-			conversion_rate := float64(total_checkout) / float64(total_impression)
-			outbound_cost_per_click := float64(parseFloat(row[4])) / float64(total_outbound_click)
-			rec := records{Records: [1]record{{Fields: fields{
-				// The comments in ALL_CAPS are the Pinterest internal names
-				// which appear in JSON returned by the Pinterest API.  When
-				// a metric does not exist in the v5 API, the comment shows
-				// how to calculate it.
-				ReportDate:     formatDaysAgo(0),
-				Start:          start_date,
-				End:            end_date,
-				CampaignID:     row[0],                                                                                // CAMPAIGN_ID
-				CampaignName:   row[1],                                                                                // CAMPAIGN_NAME
-				CampaignStatus: row[2],                                                                                // CAMPAIGN_STATUS
-				Budget:         parseFloat(row[3]),                                                                    // CAMPAIGN_DAILY_SPEND_CAP
-				Spend:          parseFloat(row[4]),                                                                    // SPEND_IN_MICRO_DOLLAR
-				Reach:          parseFloat(row[5]),                                                                    // TOTAL_IMPRESSION_USER
-				Freq:           parseFloat(row[6]),                                                                    // TOTAL_IMPRESSION_FREQUENCY
-				IM:             total_impression,                                                                      // TOTAL_IMPRESSION
-				IM1:            atoi(row[8]),                                                                          // IMPRESSION_1
-				IM2:            atoi(row[9]),                                                                          // IMPRESSION_2
-				CPM:            parseFloat(row[10]),                                                                   // CPM_IN_DOLLAR
-				PC:             total_clickthrough,                                                                    // TOTAL_CLICKTHROUGH
-				PC1:            atoi(row[12]),                                                                         // CLICKTHROUGH_1
-				PC2:            atoi(row[13]),                                                                         // CLICKTHROUGH_2
-				CTR:            parseFloat(row[14]),                                                                   // ECTR
-				CPC:            parseFloat(row[15]),                                                                   // ECPC_IN_DOLLAR
-				SV:             int(parseFloat(row[7]) * parseFloat(row[18])),                                         // TOTAL_REPIN = TOTAL_REPIN_RATE * TOTAL_IMPRESSION,
-				SV1:            atoi(row[16]),                                                                         // REPIN_1
-				SV2:            atoi(row[17]),                                                                         // REPIN_2
-				SVR:            parseFloat(row[18]),                                                                   // TOTAL_REPIN_RATE
-				SVR1:           parseFloat(row[19]),                                                                   // REPIN_RATE
-				SVR2:           parseFloat(row[17]) / parseFloat(row[7]),                                              // REPIN_RATE_2 = REPIN_2 / TOTAL_IMPRESSION
-				NGR:            parseFloat(row[20]),                                                                   // EENGAGEMENT_RATE
-				NGR1:           parseFloat(row[21]),                                                                   // ENGAGEMENT_RATE
-				NG:             atoi(row[22]),                                                                         // TOTAL_ENGAGEMENT
-				NG1:            atoi(row[23]),                                                                         // ENGAGEMENT_1
-				NG2:            atoi(row[24]),                                                                         // ENGAGEMENT_2
-				OC:             total_outbound_click,                                                                  // TOTAL_OUTBOUND_CLICK = OUTBOUND_CLICK_1 + OUTBOUND_CLICK_2
-				OC1:            atoi(row[25]),                                                                         // OUTBOUND_CLICK_1
-				OC2:            atoi(row[26]),                                                                         // OUTBOUND_CLICK_2
-				CTPV:           atoi(row[27]),                                                                         // TOTAL_CLICK_PAGE_VISIT
-				NGPV:           atoi(row[28]),                                                                         // TOTAL_ENGAGEMENT_PAGE_VISIT
-				VTPV:           atoi(row[29]),                                                                         // TOTAL_VIEW_PAGE_VISIT
-				ATC:            int(parseFloat(row[30]) * parseFloat(row[7])),                                         // TOTAL_ADD_TO_CART = TOTAL_ADD_TO_CART_CONVERSION_RATE * TOTAL_IMPRESSION
-				ATCV:           parseFloat(row[31]) + parseFloat(row[32]) + parseFloat(row[33]),                       // TOTAL_ADD_TO_CART_VALUE_IN_MICRO_DOLLAR = TOTAL_CLICK_ADD_TO_CART_VALUE_IN_MICRO_DOLLAR + TOTAL_ENGAGEMENT_ADD_TO_CART_VALUE_IN_MICRO_DOLLAR + TOTAL_VIEW_ADD_TO_CART_VALUE_IN_MICRO_DOLLAR
-				Checkouts:      total_checkout,                                                                        // TOTAL_CHECKOUT
-				CTC:            atoi(row[35]),                                                                         // TOTAL_CLICK_CHECKOUT
-				NGC:            atoi(row[36]),                                                                         // TOTAL_ENGAGEMENT_CHECKOUT
-				VTC:            atoi(row[37]),                                                                         // TOTAL_VIEW_CHECKOUT
-				Value:          parseFloat(row[38]),                                                                   // TOTAL_CHECKOUT_VALUE_IN_MICRO_DOLLAR
-				CTV:            parseFloat(row[39]),                                                                   // TOTAL_CLICK_CHECKOUT_VALUE_IN_MICRO_DOLLAR
-				NGV:            parseFloat(row[40]),                                                                   // TOTAL_ENGAGEMENT_CHECKOUT_VALUE_IN_MICRO_DOLLAR
-				VTV:            parseFloat(row[41]),                                                                   // TOTAL_VIEW_CHECKOUT_VALUE_IN_MICRO_DOLLAR
-				CPA:            parseFloat(row[42]) + parseFloat(row[43]) + parseFloat(row[44]) + parseFloat(row[45]), // CHECKOUT_COST_PER_ACTION = INAPP_CHECKOUT_COST_PER_ACTION + OFFLINE_CHECKOUT_COST_PER_ACTION + PINTEREST_CHECKOUT_COST_PER_ACTION + WEB_CHECKOUT_COST_PER_ACTION
-				ROAS:           parseFloat(row[46]),                                                                   // CHECKOUT_ROAS
-				Leads:          atoi(row[47]),                                                                         // TOTAL_LEAD
-				CR:             JSONFloat(click_ratio / 100),                                                          // TOTAL_OUTBOUND_CLICK / TOTAL_CLICKTHROUGH
-				ConvRate:       JSONFloat(conversion_rate),                                                            // TOTAL_OUTBOUND_CLICK / TOTAL_CHECKOUT
-				OCPC:           JSONFloat(outbound_cost_per_click),                                                    // SPEND_IN_MICRO_DOLLAR / TOTAL_OUTBOUND_CLICK
-			}}}, Typecast: true}
-			recJson, err := json.MarshalIndent(rec, "", "  ")
-			if err != nil {
-				panic(err)
+	return recs, nil
+}
+
+// Append (or upsert) the records to the table of the base, in batches
+// of up to 10.  A failed batch doesn't stop the others; each one is reported
+// as a BatchError with the campaign IDs in it.  When the context is done, the
+// batches that weren't sent are reported too, so every unwritten record is in
+// a BatchError.
+func (a Airtable) Write(ctx context.Context, base Base, recs []record) error {
+	var errs []error
+	all := batches(recs)
+	for i, batch := range all {
+		method, recJson, err := base.request(batch)
+		if err != nil {
+			errs = append(errs, &BatchError{campaignIds(batch), err})
+			continue
+		}
+		// DEBUG (do not delete; check in to repo)
+		// fmt.Println(string(recJson))
+
+		if _, err := a.send(ctx, method, base.ID, base.tablePath(), nil, recJson); err != nil {
+			errs = append(errs, &BatchError{campaignIds(batch), err})
+			if ctx.Err() != nil {
+				for _, skipped := range all[i+1:] {
+					errs = append(errs, &BatchError{campaignIds(skipped), ctx.Err()})
+				}
+				break
 			}
-			// DEBUG (do not delete; check in to repo)
-			// fmt.Println(string(recJson))
+		}
+
+		// DEBUG (do not delete; check in to repo)
+		// os.Exit(0)
+	}
+	return errors.Join(errs...)
+}
+
+// Print the requests that Write would send, without sending them, each as
+// its method and URL followed by its body.
+func (a Airtable) Render(w io.Writer, base Base, recs []record) error {
+	for _, batch := range batches(recs) {
+		method, body, err := base.request(batch)
+		if err != nil {
+			return &BatchError{campaignIds(batch), err}
+		}
+		if _, err := fmt.Fprintf(w, "%s %s%s\n%s\n", method, a.base, base.tablePath(), body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save the bodies of the requests that Write would send, without sending
+// them, to a file per request in a directory per table under dir, named
+// after name, e.g. dir/appa7SRvmSAh12345/Ad KPIs/549756012345-001.json.
+func (a Airtable) RenderFiles(dir string, base Base, name string, recs []record) error {
+	path := filepath.Join(dir, base.ID, strings.ReplaceAll(base.Table, "/", "_"))
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return err
+	}
+	for i, batch := range batches(recs) {
+		_, body, err := base.request(batch)
+		if err != nil {
+			return &BatchError{campaignIds(batch), err}
+		}
+		file := filepath.Join(path, fmt.Sprintf("%s-%03d.json", name, i+1))
+		if err := os.WriteFile(file, body, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The records in batches of up to batchSize.
+func batches(recs []record) [][]record {
+	var out [][]record
+	for i := 0; i < len(recs); i += batchSize {
+		end := i + batchSize
+		if end > len(recs) {
+			end = len(recs)
+		}
+		out = append(out, recs[i:end])
+	}
+	return out
+}
+
+// The method and body of the request that writes the batch to the table.
+func (b Base) request(batch []record) (string, []byte, error) {
+	method := "POST"
+	var perform *upsert
+	if b.Upsert {
+		method = "PATCH"
+		perform = &upsert{}
+		for _, f := range mergeFields {
+			perform.FieldsToMergeOn = append(perform.FieldsToMergeOn, b.field(f))
+		}
+	}
+	rec := records{Records: b.rename(batch), Typecast: true, PerformUpsert: perform}
+	body, err := json.MarshalIndent(rec, "", "  ")
+	return method, body, err
+}
 
-			a.post(baseId, recJson)
+func campaignIds(recs []record) []string {
+	ids := make([]string, len(recs))
+	for i, r := range recs {
+		ids[i], _ = r.Fields["Campaign ID"].(string)
+	}
+	return ids
+}
 
-			// DEBUG (do not delete; check in to repo)
-			// os.Exit(0)
+// Send the request for the path of the base, waiting for the base's rate
+// limit and retrying when Airtable says we've sent too many requests (429) or
+// has an error (5xx).  A POST that creates records is only retried after 429
+// or 503, when Airtable didn't process it, since otherwise the records might
+// be created twice.
+func (a Airtable) send(ctx context.Context, method string, id string, path string, query url.Values, record []byte) ([]byte, error) {
+	for attempt := 1; ; attempt++ {
+		if err := a.limiter.wait(ctx, id); err != nil {
+			return nil, err
+		}
+		body, err := a.sendOnce(ctx, method, path, query, record)
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) {
+			return body, err
+		}
+		// Every request to the base is rejected during the penalty, so the
+		// limiter makes them all wait it out, whether or not this one is
+		// retried.
+		if apiErr.StatusCode == http.StatusTooManyRequests {
+			a.limiter.penalize(id, airtablePenalty)
+		}
+		if !airtableRetryable(method, apiErr.StatusCode) || attempt >= a.retry.Attempts {
+			return nil, err
+		}
+		wait := airtablePenalty
+		if apiErr.StatusCode != http.StatusTooManyRequests {
+			wait = a.retry.backoff(attempt)
+			if err := sleep(ctx, wait); err != nil {
+				return nil, err
+			}
 		}
+		a.retries.Add(1)
+		log.Printf("airtable: base %s: %s; retry %d of %d after %v",
+			id, apiErr.Status, attempt, a.retry.Attempts-1, wait)
 	}
 }
 
-func (a Airtable) post(baseId string, record []byte) {
-	url := a.base + baseId + "/" + url.PathEscape("Ad KPIs")
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(record))
+// Reads and upserts (PATCH) can be repeated, but a POST that failed with a 5xx
+// other than 503 might have been committed.
+func airtableRetryable(method string, status int) bool {
+	if method == "POST" {
+		return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+	}
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+func (a Airtable) sendOnce(ctx context.Context, method string, path string, query url.Values, record []byte) ([]byte, error) {
+	uri := a.base + path
+	if len(query) > 0 {
+		uri += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, uri, bytes.NewBuffer(record))
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Add("Authorization", "Bearer "+a.token)
 	req.Header.Add("Content-Type", "application/json")
 	res, err := a.client.Do(req)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	defer res.Body.Close()
 
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	res.Body.Close()
 	if res.StatusCode != http.StatusOK {
-		panic("baseId: " + baseId + ", " + res.Status + ": " + string(body))
+		return nil, &APIError{req.Method, uri, res.Status, res.StatusCode, string(body)}
+	}
+	return body, nil
+}
+
+// Copies of the records with the ad account's ID and name added, for tables
+// that are shared by several accounts.
+func withAccount(recs []record, account AdAccount) []record {
+	out := make([]record, len(recs))
+	for i, r := range recs {
+		fields := make(map[string]any, len(r.Fields)+2)
+		for k, v := range r.Fields {
+			fields[k] = v
+		}
+		fields[accountIdField] = account.ID
+		fields[accountNameField] = account.Name
+		out[i] = record{r.ID, fields}
 	}
+	return out
 }
 
-func atoi(s string) int {
+// List every record in the table of the base, following Airtable's pages.
+func (a Airtable) List(ctx context.Context, base Base) ([]record, error) {
+	var recs []record
+	query := url.Values{}
+	for {
+		body, err := a.send(ctx, "GET", base.ID, base.tablePath(), query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Records []record `json:"records"`
+			Offset  string   `json:"offset"`
+		}
+		if err := json.Unmarshal(body, &page); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrParse, base.Table, err)
+		}
+		recs = append(recs, page.Records...)
+		if page.Offset == "" {
+			return recs, nil
+		}
+		query.Set("offset", page.Offset)
+	}
+}
+
+func atoi(s string) (int, error) {
 	n, err := strconv.Atoi(s)
 	if err != nil {
-		panic(err)
+		return 0, fmt.Errorf("%w: %v", ErrParse, err)
 	}
-	return n
+	return n, nil
 }
 
-func parseFloat(s string) JSONFloat {
+func parseFloat(s string) (JSONFloat, error) {
 	// Remove scientific notation which Airtable doesn't accept
 	n, err := strconv.ParseFloat(s, 64)
 	if err != nil {
-		panic(err)
+		return 0, fmt.Errorf("%w: %v", ErrParse, err)
 	}
-	return JSONFloat(n)
+	return JSONFloat(n), nil
 }
 
 type JSONFloat float64
@@ -257,10 +399,3 @@ func (j *JSONFloat) UnsmarshalJSON(v []byte) error {
 	*j = JSONFloat(fv)
 	return nil
 }
-
-func formatDaysAgo(days int) string {
-	const YYYYMMDD = "2006-01-02"
-	now := time.Now()
-	ago := now.AddDate(0, 0, -days)
-	return ago.Format(YYYYMMDD)
-}
@@ -0,0 +1,480 @@
+package airpin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"golang.org/x/oauth2/google"
+)
+
+// A Client is a Pinterest ad account and the Airtable base (and table) that
+// its metrics are copied to.  Tables and Fields are as for a Destination.
+// Destinations are more bases to copy them to, e.g. our agency base.  Clients
+// are enabled unless Enabled is false.
+// Periods are the periods (e.g. "7-day") the client is run for, all of them
+// if it's empty.  Timezone is the IANA name of the timezone the dates are in,
+// the ad account's if it's empty.
+type Client struct {
+	Name         string            `json:"name"`
+	AccountID    string            `json:"account_id"`
+	BaseID       string            `json:"base_id,omitempty"`
+	Table        string            `json:"table,omitempty"`
+	Tables       map[string]string `json:"tables,omitempty"`
+	Fields       map[string]string `json:"fields,omitempty"`
+	Upsert       bool              `json:"upsert,omitempty"`
+	Destinations []Destination     `json:"destinations,omitempty"`
+	Enabled      *bool             `json:"enabled,omitempty"`
+	Periods      []string          `json:"periods,omitempty"`
+	Timezone     string            `json:"timezone,omitempty"`
+}
+
+// A Destination is an Airtable base and table that an account is copied to.
+// Tables maps periods (e.g. "month") to the table for that period, e.g.
+// "Monthly KPIs", instead of Table.  Fields renames fields of the mapping,
+// e.g. {"Spend": "Amount Spent"}, for bases whose columns have been renamed.
+// When AccountFields is set, or another account is copied to the same table,
+// the Ad Account ID and Account Name fields are added to each row so that
+// the accounts can be told apart.
+type Destination struct {
+	BaseID        string            `json:"base_id"`
+	Table         string            `json:"table,omitempty"`
+	Tables        map[string]string `json:"tables,omitempty"`
+	Fields        map[string]string `json:"fields,omitempty"`
+	Upsert        bool              `json:"upsert,omitempty"`
+	AccountFields bool              `json:"account_fields,omitempty"`
+}
+
+// The fields added to rows in tables shared by several accounts.
+const (
+	accountIdField   = "Ad Account ID"
+	accountNameField = "Account Name"
+)
+
+// The table that clients are copied to unless they say otherwise.
+const defaultTable = "Ad KPIs"
+
+func (c Client) enabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
+
+func (c Client) scheduled(period Period) bool {
+	if len(c.Periods) == 0 {
+		return true
+	}
+	for _, p := range c.Periods {
+		if p == period.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// The timezone of the client's dates: its Timezone, which has already been
+// validated, or else the ad account's.  Guessing would shift every date by a
+// day around midnight, so it's an error if the account's is missing or
+// unknown; setting the client's Timezone fixes it.
+func (c Client) location(account AdAccount) (*time.Location, error) {
+	if c.Timezone != "" {
+		return time.LoadLocation(c.Timezone)
+	}
+	if account.TimeZone == "" {
+		return nil, fmt.Errorf("%w: account %s has no timezone; set the client's timezone", ErrParse, account.ID)
+	}
+	loc, err := time.LoadLocation(account.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("%w: account %s: unknown timezone %q; set the client's timezone", ErrParse, account.ID, account.TimeZone)
+	}
+	return loc, nil
+}
+
+// Every destination of the client, starting with BaseID if it's set.
+func (c Client) destinations() []Destination {
+	var dests []Destination
+	if c.BaseID != "" {
+		dests = append(dests, Destination{
+			BaseID: c.BaseID,
+			Table:  c.Table,
+			Tables: c.Tables,
+			Fields: c.Fields,
+			Upsert: c.Upsert,
+		})
+	}
+	return append(dests, c.Destinations...)
+}
+
+// The periods that could be written, which are the named ones and any others
+// the destination has a table for.
+func (d Destination) periods() []Period {
+	ps := append([]Period{}, periods...)
+	for p := range d.Tables {
+		if _, err := parsePeriod(p); err == nil && !containsPeriod(ps, Period(p)) {
+			ps = append(ps, Period(p))
+		}
+	}
+	return ps
+}
+
+func containsPeriod(ps []Period, p Period) bool {
+	for _, q := range ps {
+		if q == p {
+			return true
+		}
+	}
+	return false
+}
+
+// The base and table to write the period to, if any.  A destination with
+// Tables but no Table is only written for the periods in Tables.
+func (d Destination) base(period Period) (Base, bool) {
+	table := d.Tables[period.String()]
+	if table == "" {
+		if d.Table == "" && len(d.Tables) > 0 {
+			return Base{}, false
+		}
+		table = d.Table
+	}
+	if table == "" {
+		table = defaultTable
+	}
+	return Base{d.BaseID, table, d.Upsert, d.AccountFields, d.Fields}, true
+}
+
+// The bases that each client's account is written to for the period, keyed by
+// account ID.  AccountFields is set on the bases of tables that more than one
+// of the clients is written to.
+func route(clients []Client, period Period) map[string][]Base {
+	tables := map[string]map[string]bool{}
+	for _, c := range clients {
+		for _, d := range c.destinations() {
+			b, ok := d.base(period)
+			if !ok {
+				continue
+			}
+			if tables[b.path()] == nil {
+				tables[b.path()] = map[string]bool{}
+			}
+			tables[b.path()][c.AccountID] = true
+		}
+	}
+	routes := map[string][]Base{}
+	for _, c := range clients {
+		for _, d := range c.destinations() {
+			b, ok := d.base(period)
+			if !ok {
+				continue
+			}
+			if len(tables[b.path()]) > 1 {
+				b.AccountFields = true
+			}
+			routes[c.AccountID] = append(routes[c.AccountID], b)
+		}
+	}
+	return routes
+}
+
+// Every base and table that the enabled clients are written to, for the
+// periods they're scheduled for.
+func Bases(clients []Client) []Base {
+	var enabled []Client
+	for _, c := range clients {
+		if c.enabled() {
+			enabled = append(enabled, c)
+		}
+	}
+	all := append([]Period{}, periods...)
+	for _, c := range enabled {
+		for _, p := range c.Periods {
+			if p, err := parsePeriod(p); err == nil && !containsPeriod(all, p) {
+				all = append(all, p)
+			}
+		}
+		for _, d := range c.destinations() {
+			for _, p := range d.periods() {
+				if !containsPeriod(all, p) {
+					all = append(all, p)
+				}
+			}
+		}
+	}
+	var bases []Base
+	seen := map[string]bool{}
+	for _, period := range all {
+		routes := route(enabled, period)
+		for _, c := range enabled {
+			if !c.scheduled(period) {
+				continue
+			}
+			for _, b := range routes[c.AccountID] {
+				if !seen[b.path()] {
+					seen[b.path()] = true
+					bases = append(bases, b)
+				}
+			}
+		}
+	}
+	return bases
+}
+
+// Load the clients from source, which is one of:
+//
+//   - a JSON array of clients, e.g. from a secret mounted as an environment
+//     variable
+//   - airtable:BASE/TABLE, a table in an Airtable "control" base, which is
+//     read with air (see clientFields)
+//   - gs://BUCKET/OBJECT, a JSON file in Google Cloud Storage
+//   - projects/PROJECT/secrets/SECRET/versions/VERSION, a JSON secret in
+//     Google Cloud Secret Manager
+//   - the path of a local JSON file, for development
+//
+// The clients are validated, so that a mistake is found before anything is
+// fetched from Pinterest.
+func LoadClients(ctx context.Context, source string, air *Airtable) ([]Client, error) {
+	var data []byte
+	var err error
+	switch {
+	case strings.HasPrefix(strings.TrimSpace(source), "["):
+		data = []byte(source)
+	case strings.HasPrefix(source, "airtable:"):
+		data, err = readControlTable(ctx, strings.TrimPrefix(source, "airtable:"), air)
+	case strings.HasPrefix(source, "gs://"):
+		data, err = readObject(ctx, source)
+	case strings.HasPrefix(source, "projects/"):
+		data, err = readSecret(ctx, source)
+	default:
+		data, err = os.ReadFile(source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("clients: %w", err)
+	}
+
+	var clients []Client
+	if err := json.Unmarshal(data, &clients); err != nil {
+		return nil, fmt.Errorf("clients: %w: %v", ErrParse, err)
+	}
+	if err := validateClients(clients); err != nil {
+		return nil, fmt.Errorf("clients: %w", err)
+	}
+	return clients, nil
+}
+
+// Report every problem with the enabled clients, not just the first.
+func validateClients(clients []Client) error {
+	var errs []error
+	accounts := map[string]bool{}
+	tables := map[string]Base{}
+	for i, c := range clients {
+		// Inactive clients, e.g. rows in the control base that are still
+		// being filled in, aren't used, so they needn't be valid.
+		if !c.enabled() {
+			continue
+		}
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		if c.AccountID == "" {
+			errs = append(errs, fmt.Errorf("%s: account_id is required", name))
+		} else if accounts[c.AccountID] {
+			errs = append(errs, fmt.Errorf("%s: account %s is listed more than once", name, c.AccountID))
+		}
+		accounts[c.AccountID] = true
+		dests := c.destinations()
+		if len(dests) == 0 {
+			errs = append(errs, fmt.Errorf("%s: base_id or destinations is required", name))
+		}
+		for _, d := range dests {
+			if !strings.HasPrefix(d.BaseID, "app") {
+				errs = append(errs, fmt.Errorf("%s: base_id %q is not an Airtable base ID", name, d.BaseID))
+				continue
+			}
+			for p := range d.Tables {
+				if !validPeriod(p) {
+					errs = append(errs, fmt.Errorf("%s: table for unknown period %q", name, p))
+				}
+			}
+			for f := range d.Fields {
+				if !knownField(f) {
+					errs = append(errs, fmt.Errorf("%s: can't rename unknown field %q", name, f))
+				}
+			}
+			// Every account written to a table has to agree on how.
+			for _, p := range d.periods() {
+				b, ok := d.base(p)
+				if !ok {
+					continue
+				}
+				if t, ok := tables[b.path()]; ok && (t.Upsert != b.Upsert || !sameFields(t.Fields, b.Fields)) {
+					errs = append(errs, fmt.Errorf("%s: %s is written differently by another client", name, b.path()))
+				}
+				tables[b.path()] = b
+			}
+		}
+		for _, p := range c.Periods {
+			if !validPeriod(p) {
+				errs = append(errs, fmt.Errorf("%s: unknown period %q", name, p))
+			}
+		}
+		if _, err := time.LoadLocation(c.Timezone); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Whether the renames are the same, treating no renames and an empty object
+// alike.
+func sameFields(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether the field is written by Airpin, so that it can be renamed.
+func knownField(name string) bool {
+	switch name {
+	case "Report Date", "Start", "End", accountIdField, accountNameField:
+		return true
+	}
+	for _, f := range mapping.Fields {
+		if f.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func validPeriod(name string) bool {
+	_, err := parsePeriod(name)
+	return err == nil
+}
+
+// The fields of the clients table in the control base.  Active is a checkbox
+// and Periods is a multiple select of the period names.  Airtable Base ID can
+// list several bases, separated by commas, to copy the account to each of
+// them.
+var clientFields = struct {
+	Name, AccountID, BaseID, Table, Active, Upsert, Periods, Timezone string
+}{
+	Name:      "Name",
+	AccountID: "Pinterest Ad Account ID",
+	BaseID:    "Airtable Base ID",
+	Table:     "Table Name",
+	Active:    "Active",
+	Upsert:    "Upsert",
+	Periods:   "Periods",
+	Timezone:  "Timezone",
+}
+
+// Read the clients table of the control base at path (BASE/TABLE), as JSON so
+// that it's loaded like the other sources.  Airtable omits empty fields, so
+// an unchecked Active is false.
+func readControlTable(ctx context.Context, path string, air *Airtable) ([]byte, error) {
+	baseId, table, ok := strings.Cut(path, "/")
+	if !ok || table == "" {
+		return nil, fmt.Errorf("airtable:%s is not airtable:BASE/TABLE", path)
+	}
+	recs, err := air.List(ctx, Base{ID: baseId, Table: table})
+	if err != nil {
+		return nil, err
+	}
+
+	f := clientFields
+	clients := make([]Client, 0, len(recs))
+	for _, r := range recs {
+		active, _ := r.Fields[f.Active].(bool)
+		upsert, _ := r.Fields[f.Upsert].(bool)
+		c := Client{
+			Name:      text(r.Fields[f.Name]),
+			AccountID: text(r.Fields[f.AccountID]),
+			Enabled:   &active,
+			Timezone:  text(r.Fields[f.Timezone]),
+		}
+		for _, id := range strings.Split(text(r.Fields[f.BaseID]), ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				c.Destinations = append(c.Destinations, Destination{
+					BaseID: id,
+					Table:  text(r.Fields[f.Table]),
+					Upsert: upsert,
+				})
+			}
+		}
+		periods, _ := r.Fields[f.Periods].([]any)
+		for _, p := range periods {
+			c.Periods = append(c.Periods, text(p))
+		}
+		clients = append(clients, c)
+	}
+	return json.Marshal(clients)
+}
+
+// The text of an Airtable field value.  Numbers are formatted without a
+// decimal point, since ad account IDs are sometimes stored as numbers.
+func text(v any) string {
+	switch v := v.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+func readObject(ctx context.Context, source string) ([]byte, error) {
+	bucket, object, _ := strings.Cut(strings.TrimPrefix(source, "gs://"), "/")
+	client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/devstorage.read_only")
+	if err != nil {
+		return nil, err
+	}
+	uri := fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s?alt=media",
+		url.PathEscape(bucket), url.PathEscape(object))
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, &APIError{req.Method, source, res.Status, res.StatusCode, string(body)}
+	}
+	return body, nil
+}
+
+func readSecret(ctx context.Context, name string) ([]byte, error) {
+	client, err := secretmanager.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	req := &secretmanagerpb.AccessSecretVersionRequest{Name: name}
+	res, err := client.AccessSecretVersion(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return res.Payload.Data, nil
+}
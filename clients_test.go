@@ -0,0 +1,164 @@
+package airpin
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func clients(t *testing.T, src string) []Client {
+	t.Helper()
+	var cs []Client
+	if err := json.Unmarshal([]byte(src), &cs); err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+	return cs
+}
+
+func TestValidateClients(t *testing.T) {
+	tests := []struct {
+		name    string
+		clients string
+		want    []string
+	}{
+		{"valid", `[
+			{"name": "A", "account_id": "1", "base_id": "appA"},
+			{"name": "B", "account_id": "2", "base_id": "appB", "tables": {"month": "Monthly KPIs", "14-day": "Fortnight"}, "periods": ["month", "14-day"], "timezone": "America/New_York"}
+		]`, nil},
+		{"empty fields are no fields", `[
+			{"name": "A", "account_id": "1", "base_id": "appA", "fields": {}},
+			{"name": "B", "account_id": "2", "base_id": "appA"}
+		]`, nil},
+		{"same renames", `[
+			{"name": "A", "account_id": "1", "base_id": "appA", "fields": {"Spend": "Amount Spent"}},
+			{"name": "B", "account_id": "2", "base_id": "appA", "fields": {"Spend": "Amount Spent"}}
+		]`, nil},
+		{"different renames", `[
+			{"name": "A", "account_id": "1", "base_id": "appA", "fields": {"Spend": "Amount Spent"}},
+			{"name": "B", "account_id": "2", "base_id": "appA", "fields": {"Spend": "Cost"}}
+		]`, []string{"B: appA/Ad KPIs is written differently by another client"}},
+		{"renames and none", `[
+			{"name": "A", "account_id": "1", "base_id": "appA", "fields": {"Spend": "Amount Spent"}},
+			{"name": "B", "account_id": "2", "base_id": "appA"}
+		]`, []string{"B: appA/Ad KPIs is written differently"}},
+		{"upsert and append", `[
+			{"name": "A", "account_id": "1", "base_id": "appA", "upsert": true},
+			{"name": "B", "account_id": "2", "base_id": "appA"}
+		]`, []string{"B: appA/Ad KPIs is written differently"}},
+		{"different tables", `[
+			{"name": "A", "account_id": "1", "base_id": "appA", "upsert": true},
+			{"name": "B", "account_id": "2", "base_id": "appA", "table": "Other"}
+		]`, nil},
+		{"period tables only", `[
+			{"name": "A", "account_id": "1", "base_id": "appA", "tables": {"month": "Monthly KPIs"}},
+			{"name": "B", "account_id": "2", "base_id": "appA", "upsert": true}
+		]`, nil},
+		{"unknown field", `[
+			{"name": "A", "account_id": "1", "base_id": "appA", "fields": {"Spent": "Amount Spent", "Start": "From", "Ad Account ID": "Account"}}
+		]`, []string{`A: can't rename unknown field "Spent"`}},
+		{"unknown period", `[
+			{"name": "A", "account_id": "1", "base_id": "appA", "tables": {"fortnight": "Fortnight"}, "periods": ["0-day"]}
+		]`, []string{`A: table for unknown period "fortnight"`, `A: unknown period "0-day"`}},
+		{"missing and duplicate", `[
+			{"name": "A", "base_id": "appA"},
+			{"name": "B", "account_id": "2"},
+			{"account_id": "2", "base_id": "tblA"}
+		]`, []string{"A: account_id is required", "B: base_id or destinations is required", "#3: account 2 is listed more than once", `#3: base_id "tblA" is not an Airtable base ID`}},
+		{"bad timezone", `[
+			{"name": "A", "account_id": "1", "base_id": "appA", "timezone": "Mars/Olympus"}
+		]`, []string{"A: unknown time zone Mars/Olympus"}},
+		{"disabled", `[
+			{"name": "A", "enabled": false}
+		]`, nil},
+	}
+	for _, tt := range tests {
+		err := validateClients(clients(t, tt.clients))
+		if len(tt.want) == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: no error, want %q", tt.name, tt.want)
+			continue
+		}
+		got := strings.Split(err.Error(), "\n")
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: %d errors, want %d: %v", tt.name, len(got), len(tt.want), err)
+			continue
+		}
+		for i, want := range tt.want {
+			if !strings.Contains(got[i], want) {
+				t.Errorf("%s: error %q, want %q", tt.name, got[i], want)
+			}
+		}
+	}
+}
+
+func TestRoute(t *testing.T) {
+	cs := clients(t, `[
+		{"name": "A", "account_id": "1", "base_id": "appA", "destinations": [{"base_id": "appAgency", "table": "All KPIs"}]},
+		{"name": "B", "account_id": "2", "base_id": "appB", "tables": {"month": "Monthly KPIs"}, "destinations": [{"base_id": "appAgency", "table": "All KPIs"}]},
+		{"name": "C", "account_id": "3", "base_id": "appC", "table": "KPIs", "tables": {"month": "Monthly KPIs"}, "fields": {"Spend": "Amount Spent"}},
+		{"name": "D", "account_id": "4", "destinations": [{"base_id": "appD", "account_fields": true, "upsert": true}]}
+	]`)
+	tests := []struct {
+		period Period
+		want   map[string][]Base
+	}{
+		{Week, map[string][]Base{
+			"1": {{ID: "appA", Table: "Ad KPIs"}, {ID: "appAgency", Table: "All KPIs", AccountFields: true}},
+			"2": {{ID: "appAgency", Table: "All KPIs", AccountFields: true}},
+			"3": {{ID: "appC", Table: "KPIs", Fields: map[string]string{"Spend": "Amount Spent"}}},
+			"4": {{ID: "appD", Table: "Ad KPIs", Upsert: true, AccountFields: true}},
+		}},
+		{Month, map[string][]Base{
+			"1": {{ID: "appA", Table: "Ad KPIs"}, {ID: "appAgency", Table: "All KPIs", AccountFields: true}},
+			"2": {{ID: "appB", Table: "Monthly KPIs"}, {ID: "appAgency", Table: "All KPIs", AccountFields: true}},
+			"3": {{ID: "appC", Table: "Monthly KPIs", Fields: map[string]string{"Spend": "Amount Spent"}}},
+			"4": {{ID: "appD", Table: "Ad KPIs", Upsert: true, AccountFields: true}},
+		}},
+	}
+	for _, tt := range tests {
+		if got := route(cs, tt.period); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("route(%s) = %+v, want %+v", tt.period, got, tt.want)
+		}
+	}
+}
+
+func TestRouteSharedTable(t *testing.T) {
+	// Two accounts in the same table for one period, but not the other.
+	cs := clients(t, `[
+		{"name": "A", "account_id": "1", "base_id": "appA", "tables": {"month": "Monthly KPIs"}, "table": "Ad KPIs"},
+		{"name": "B", "account_id": "2", "base_id": "appA", "table": "Weekly KPIs", "tables": {"month": "Monthly KPIs"}}
+	]`)
+	week := route(cs, Week)
+	month := route(cs, Month)
+	if week["1"][0].AccountFields || week["2"][0].AccountFields {
+		t.Errorf("route(7-day) = %+v, want separate tables without account fields", week)
+	}
+	if !month["1"][0].AccountFields || !month["2"][0].AccountFields {
+		t.Errorf("route(month) = %+v, want a shared table with account fields", month)
+	}
+}
+
+func TestBases(t *testing.T) {
+	cs := clients(t, `[
+		{"name": "A", "account_id": "1", "base_id": "appA", "tables": {"month": "Monthly KPIs"}},
+		{"name": "B", "account_id": "2", "base_id": "appB", "periods": ["month"]},
+		{"name": "C", "account_id": "3", "base_id": "appC", "table": "Fortnight", "periods": ["14-day"]},
+		{"name": "D", "account_id": "4", "base_id": "appD", "table": "Weekly", "tables": {"month": "Monthly"}, "periods": ["7-day"]},
+		{"name": "E", "account_id": "5", "base_id": "appE", "enabled": false}
+	]`)
+	var got []string
+	for _, b := range Bases(cs) {
+		got = append(got, b.path())
+	}
+	// In order of the periods, then the clients; D isn't run monthly.
+	want := []string{"appD/Weekly", "appA/Monthly KPIs", "appB/Ad KPIs", "appC/Fortnight"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Bases = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,237 @@
+// Airpin runs the function from the command line, without the functions
+// framework, along with the tools that go with it:
+//
+//	airpin run [-period 7-day] [-account ID]... [-start DATE -end DATE] [-dry-run]
+//	airpin backfill -period month -start DATE -end DATE [-account ID]...
+//	airpin preflight
+//	airpin provision [-base ID [-table NAME] [-account-fields]]
+//	airpin templates -account ID
+//	airpin metrics
+//
+// It's configured by the same environment variables as the function.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+
+	"fuzzytuxedomedia.com/airpin"
+	"github.com/caarlos0/env/v8"
+)
+
+type airtableConfig struct {
+	AirtableToken string       `env:"AIRTABLE_TOKEN,required"`
+	Clients       string       `env:"CLIENTS" envDefault:"clients.json"`
+	Retry         airpin.Retry `envPrefix:"AIRTABLE_"`
+}
+
+type pinterestConfig struct {
+	PinterestToken string `env:"PINTEREST_TOKEN,required"`
+	airpin.Polling
+	Retry airpin.Retry `envPrefix:"PINTEREST_"`
+}
+
+var commands = map[string]func(ctx context.Context, args []string) error{
+	"run":       run,
+	"backfill":  backfill,
+	"preflight": preflight,
+	"provision": provision,
+	"templates": templates,
+	"metrics":   metrics,
+}
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		log.Fatal("usage: airpin run|backfill|preflight|provision|templates|metrics [flags]")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := commands[os.Args[1]](ctx, os.Args[2:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// accounts is a flag that can be repeated, or a comma-separated list.
+type accounts []string
+
+func (a *accounts) String() string {
+	return strings.Join(*a, ",")
+}
+
+func (a *accounts) Set(s string) error {
+	*a = append(*a, strings.Split(s, ",")...)
+	return nil
+}
+
+// The flags of run and backfill, which are the options of the JSON message.
+func runFlags(name string, args []string) (airpin.RunOptions, string, error) {
+	opts := airpin.RunOptions{Period: airpin.Week}
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.TextVar(&opts.Period, "period", airpin.Week, "the period to run, e.g. month")
+	fs.Var((*accounts)(&opts.Accounts), "account", "only run this ad account (repeatable)")
+	fs.StringVar(&opts.Start, "start", "", "the first date to fetch, e.g. 2024-01-01")
+	fs.StringVar(&opts.End, "end", "", "the last date to fetch")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "render the Airtable requests instead of sending them")
+	dryRunDir := fs.String("dry-run-dir", "", "save the rendered requests to this directory instead of stdout")
+	fs.StringVar(&opts.Granularity, "granularity", "", "TOTAL, DAY, WEEK or MONTH")
+	err := fs.Parse(args)
+	return opts, *dryRunDir, err
+}
+
+func run(ctx context.Context, args []string) error {
+	opts, dryRunDir, err := runFlags("run", args)
+	if err != nil {
+		return err
+	}
+	return do(ctx, opts, dryRunDir)
+}
+
+func backfill(ctx context.Context, args []string) error {
+	opts, dryRunDir, err := runFlags("backfill", args)
+	if err != nil {
+		return err
+	}
+	opts.Backfill = true
+	return do(ctx, opts, dryRunDir)
+}
+
+// Do the run as the function would, and log its summary.
+func do(ctx context.Context, opts airpin.RunOptions, dryRunDir string) error {
+	r, err := opts.Run()
+	if err != nil {
+		return err
+	}
+	conf := airpin.Config{}
+	if err := env.Parse(&conf); err != nil {
+		return err
+	}
+	if dryRunDir != "" {
+		conf.DryRunDir = dryRunDir
+	}
+	if err := r.Configure(conf); err != nil {
+		return err
+	}
+	summary, err := r.Do(ctx, conf)
+	data, _ := json.MarshalIndent(summary, "", "  ")
+	log.Printf("summary: %s", data)
+	return err
+}
+
+// Check the tables of every client against the mapping.
+func preflight(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("preflight", flag.ExitOnError)
+	fs.Parse(args)
+	conf := airtableConfig{}
+	if err := env.Parse(&conf); err != nil {
+		return err
+	}
+	air := airpin.NewAirtable(conf.AirtableToken, conf.Retry)
+	clients, err := airpin.LoadClients(ctx, conf.Clients, air)
+	if err != nil {
+		return err
+	}
+	bases := airpin.Bases(clients)
+	if err := air.Preflight(ctx, bases); err != nil {
+		return err
+	}
+	fmt.Printf("%d tables match the mapping\n", len(bases))
+	return nil
+}
+
+// Create the Ad KPIs table, or the fields it's missing, in the bases that the
+// clients are written to.  To provision a single new base before it's added
+// to the clients, pass -base (and -table).
+func provision(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("provision", flag.ExitOnError)
+	base := fs.String("base", "", "the ID of a base to provision, instead of the clients' bases")
+	table := fs.String("table", "Ad KPIs", "the table to provision with -base")
+	accountFields := fs.Bool("account-fields", false, "add the Ad Account ID and Account Name fields with -base")
+	fs.Parse(args)
+
+	conf := airtableConfig{}
+	if err := env.Parse(&conf); err != nil {
+		return err
+	}
+	air := airpin.NewAirtable(conf.AirtableToken, conf.Retry)
+
+	var bases []airpin.Base
+	if *base != "" {
+		bases = []airpin.Base{{ID: *base, Table: *table, AccountFields: *accountFields}}
+	} else {
+		clients, err := airpin.LoadClients(ctx, conf.Clients, air)
+		if err != nil {
+			return err
+		}
+		bases = airpin.Bases(clients)
+	}
+
+	failed := false
+	for _, b := range bases {
+		if err := air.Provision(ctx, b, describe); err != nil {
+			log.Println(err)
+			failed = true
+		}
+	}
+	if failed {
+		return fmt.Errorf("provisioning failed")
+	}
+	return nil
+}
+
+// Print the report templates of an ad account, to copy into config.json.
+func templates(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("templates", flag.ExitOnError)
+	account := fs.String("account", "", "the ad account whose templates to get")
+	fs.Parse(args)
+	if *account == "" {
+		return fmt.Errorf("templates: -account is required")
+	}
+	pin, err := newPinterest()
+	if err != nil {
+		return err
+	}
+	data, err := pin.Templates(ctx, *account)
+	if err != nil {
+		return err
+	}
+	return printJSON(data)
+}
+
+// Print Pinterest's definitions of the report columns, for metrics.json.
+func metrics(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("metrics", flag.ExitOnError)
+	fs.Parse(args)
+	pin, err := newPinterest()
+	if err != nil {
+		return err
+	}
+	data, err := pin.Metrics(ctx)
+	if err != nil {
+		return err
+	}
+	return printJSON(data)
+}
+
+func newPinterest() (*airpin.Pinterest, error) {
+	conf := pinterestConfig{}
+	if err := env.Parse(&conf); err != nil {
+		return nil, err
+	}
+	return airpin.NewPinterest(conf.PinterestToken, conf.Polling, conf.Retry), nil
+}
+
+func printJSON(data json.RawMessage) error {
+	out, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+)
+
+// Pinterest's definitions of the report columns, from metrics.sh.  They're
+// only needed to provision tables, so they aren't deployed with the function.
+//
+//go:embed "metrics.json"
+var metricsJson []byte
+
+type metric struct {
+	Name        string `json:"name"`
+	Definition  string `json:"definition"`
+	DisplayName string `json:"display_name"`
+}
+
+var definitions = newDefinitions(metricsJson)
+
+func newDefinitions(data []byte) map[string]metric {
+	var m struct {
+		Items []metric `json:"items"`
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		panic(err)
+	}
+	definitions := make(map[string]metric, len(m.Items))
+	for _, item := range m.Items {
+		definitions[item.Name] = item
+	}
+	return definitions
+}
+
+// Pinterest's definition of the column, for the description of its field.
+func describe(column string) string {
+	m, ok := definitions[column]
+	if !ok {
+		return column
+	}
+	if m.DisplayName == "" {
+		return fmt.Sprintf("%s (%s)", m.Definition, column)
+	}
+	return fmt.Sprintf("%s: %s (%s)", m.DisplayName, m.Definition, column)
+}
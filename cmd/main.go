@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
 
@@ -10,6 +11,18 @@ import (
 )
 
 func main() {
+	// -dry-run renders the Airtable requests instead of sending them, as
+	// DRY_RUN does, to stdout or to the files in -dry-run-dir.
+	dryRun := flag.Bool("dry-run", false, "render the Airtable requests instead of sending them")
+	dryRunDir := flag.String("dry-run-dir", "", "save the rendered requests to this directory instead of stdout")
+	flag.Parse()
+	if *dryRun {
+		os.Setenv("DRY_RUN", "true")
+	}
+	if *dryRunDir != "" {
+		os.Setenv("DRY_RUN_DIR", *dryRunDir)
+	}
+
 	// Use PORT environment variable, or default to 8080.
 	port := "8080"
 	if envPort := os.Getenv("PORT"); envPort != "" {
@@ -0,0 +1,209 @@
+package airpin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Period is the name of a range of dates relative to the day of a run, as
+// in the Pub/Sub message.  Besides these, "N-day" is the last N days (not
+// including today), of which Week is one.
+type Period string
+
+const (
+	Yesterday    Period = "yesterday"
+	Week         Period = "7-day"
+	CalendarWeek Period = "week"
+	Month        Period = "month"
+	Quarter      Period = "quarter"
+	MonthToDate  Period = "mtd"
+	YearToDate   Period = "ytd"
+)
+
+var periods = []Period{Yesterday, Week, CalendarWeek, Month, Quarter, MonthToDate, YearToDate}
+
+// The last n days, not including today.
+func Rolling(n int) Period {
+	return Period(strconv.Itoa(n) + "-day")
+}
+
+func (p Period) String() string {
+	return string(p)
+}
+
+// The number of days in an "N-day" period, or 0 for the others.
+func (p Period) days() int {
+	n, err := strconv.Atoi(strings.TrimSuffix(string(p), "-day"))
+	if err != nil || !strings.HasSuffix(string(p), "-day") {
+		return 0
+	}
+	return n
+}
+
+func parsePeriod(name string) (Period, error) {
+	for _, p := range periods {
+		if name == p.String() {
+			return p, nil
+		}
+	}
+	if n := Period(name).days(); n > 0 && n <= maxReportDays {
+		return Period(name), nil
+	}
+	return "", fmt.Errorf("%w: invalid period %q", ErrParse, name)
+}
+
+func (p Period) MarshalText() ([]byte, error) {
+	return []byte(p), nil
+}
+
+func (p *Period) UnmarshalText(text []byte) error {
+	period, err := parsePeriod(string(text))
+	if err != nil {
+		return err
+	}
+	*p = period
+	return nil
+}
+
+// The last period before the date of now, in now's location.  Calendar weeks
+// start on weekStart.  Month-to-date and year-to-date run to yesterday, so on
+// the first of the month they're the whole of the last month (or year).
+func (p Period) Range(now time.Time, weekStart time.Weekday) DateRange {
+	today := date(now)
+	yesterday := today.AddDate(0, 0, -1)
+	switch p {
+	case Yesterday:
+		return DateRange{yesterday, yesterday}
+	case CalendarWeek:
+		start := startOfWeek(today, weekStart).AddDate(0, 0, -7)
+		return DateRange{start, start.AddDate(0, 0, 6)}
+	case Month:
+		start := time.Date(today.Year(), today.Month()-1, 1, 0, 0, 0, 0, time.UTC)
+		return DateRange{start, start.AddDate(0, 1, -1)}
+	case Quarter:
+		start := startOfQuarter(today).AddDate(0, -3, 0)
+		return DateRange{start, start.AddDate(0, 3, -1)}
+	case MonthToDate:
+		return DateRange{time.Date(yesterday.Year(), yesterday.Month(), 1, 0, 0, 0, 0, time.UTC), yesterday}
+	case YearToDate:
+		return DateRange{time.Date(yesterday.Year(), 1, 1, 0, 0, 0, 0, time.UTC), yesterday}
+	default:
+		return DateRange{today.AddDate(0, 0, -p.days()), yesterday}
+	}
+}
+
+// The period starting on the date, cut off at end.  Periods that run to date
+// are split like the periods they're part of, e.g. month-to-date by months.
+func (p Period) from(start, end time.Time, weekStart time.Weekday) DateRange {
+	var next time.Time
+	switch p {
+	case Yesterday:
+		next = start
+	case CalendarWeek:
+		next = startOfWeek(start, weekStart).AddDate(0, 0, 6)
+	case Month, MonthToDate:
+		next = time.Date(start.Year(), start.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, 1, -1)
+	case Quarter:
+		next = startOfQuarter(start).AddDate(0, 3, -1)
+	case YearToDate:
+		next = time.Date(start.Year(), 12, 31, 0, 0, 0, 0, time.UTC)
+	default:
+		next = start.AddDate(0, 0, p.days()-1)
+	}
+	if next.After(end) {
+		next = end
+	}
+	return DateRange{start, next}
+}
+
+// The first day of the week that the date is in.
+func startOfWeek(d time.Time, weekStart time.Weekday) time.Time {
+	return d.AddDate(0, 0, -((int(d.Weekday()) - int(weekStart) + 7) % 7))
+}
+
+// The first day of the quarter that the date is in.
+func startOfQuarter(d time.Time) time.Time {
+	return time.Date(d.Year(), d.Month()-(d.Month()-1)%3, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// The day of the week, e.g. "monday".
+func parseWeekday(name string) (time.Weekday, error) {
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(name, d.String()) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: invalid weekday %q", ErrParse, name)
+}
+
+// A Clock tells the time, so that "today" can be fixed when checking the
+// date math.  The zero Clock is the system's.
+type Clock func() time.Time
+
+func (c Clock) Now() time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	return c()
+}
+
+const dateLayout = "2006-01-02"
+
+// A DateRange is the dates from Start to End, inclusive.  The dates are
+// midnight UTC, since they're the same days wherever the account is.
+type DateRange struct {
+	Start time.Time
+	End   time.Time
+}
+
+// The date of t in its location, as midnight UTC.
+func date(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func parseDateRange(start, end string) (DateRange, error) {
+	s, err := time.Parse(dateLayout, start)
+	if err != nil {
+		return DateRange{}, fmt.Errorf("%w: start: %v", ErrParse, err)
+	}
+	e, err := time.Parse(dateLayout, end)
+	if err != nil {
+		return DateRange{}, fmt.Errorf("%w: end: %v", ErrParse, err)
+	}
+	if e.Before(s) {
+		return DateRange{}, fmt.Errorf("%w: end %s is before start %s", ErrParse, end, start)
+	}
+	return DateRange{s, e}, nil
+}
+
+func (r DateRange) String() string {
+	return r.Start.Format(dateLayout) + " to " + r.End.Format(dateLayout)
+}
+
+// The range split into consecutive periods, e.g. calendar months.  The first
+// and last are cut off at the start and end of the range.
+func (r DateRange) Split(p Period, weekStart time.Weekday) []DateRange {
+	var ranges []DateRange
+	for start := r.Start; !start.After(r.End); {
+		next := p.from(start, r.End, weekStart)
+		ranges = append(ranges, next)
+		start = next.End.AddDate(0, 0, 1)
+	}
+	return ranges
+}
+
+// The range split into consecutive ranges of up to days days.
+func (r DateRange) Chunk(days int) []DateRange {
+	var ranges []DateRange
+	for start := r.Start; !start.After(r.End); start = start.AddDate(0, 0, days) {
+		end := start.AddDate(0, 0, days-1)
+		if end.After(r.End) {
+			end = r.End
+		}
+		ranges = append(ranges, DateRange{start, end})
+	}
+	return ranges
+}
@@ -0,0 +1,224 @@
+package airpin
+
+import (
+	"reflect"
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func day(s string) time.Time {
+	d, err := time.Parse(dateLayout, s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func dates(start, end string) DateRange {
+	return DateRange{day(start), day(end)}
+}
+
+// A clock fixed at the instant, which is a different day in UTC than in the
+// location it's read in.
+func fixed(instant string) Clock {
+	t, err := time.Parse(time.RFC3339, instant)
+	if err != nil {
+		panic(err)
+	}
+	return func() time.Time { return t }
+}
+
+func TestRange(t *testing.T) {
+	losAngeles, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		clock     Clock
+		loc       *time.Location
+		period    Period
+		weekStart time.Weekday
+		want      DateRange
+	}{
+		// 23:30 on Sunday, December 31 in Los Angeles, but January 1 in UTC.
+		{fixed("2024-01-01T07:30:00Z"), losAngeles, Yesterday, time.Monday, dates("2023-12-30", "2023-12-30")},
+		{fixed("2024-01-01T07:30:00Z"), losAngeles, Week, time.Monday, dates("2023-12-24", "2023-12-30")},
+		{fixed("2024-01-01T07:30:00Z"), losAngeles, CalendarWeek, time.Monday, dates("2023-12-18", "2023-12-24")},
+		{fixed("2024-01-01T07:30:00Z"), losAngeles, CalendarWeek, time.Sunday, dates("2023-12-24", "2023-12-30")},
+		{fixed("2024-01-01T07:30:00Z"), losAngeles, Month, time.Monday, dates("2023-11-01", "2023-11-30")},
+		{fixed("2024-01-01T07:30:00Z"), losAngeles, Quarter, time.Monday, dates("2023-07-01", "2023-09-30")},
+		{fixed("2024-01-01T07:30:00Z"), losAngeles, MonthToDate, time.Monday, dates("2023-12-01", "2023-12-30")},
+		{fixed("2024-01-01T07:30:00Z"), losAngeles, YearToDate, time.Monday, dates("2023-01-01", "2023-12-30")},
+
+		// 00:30 on Monday, January 1 in Tokyo, but December 31 in UTC.
+		{fixed("2023-12-31T15:30:00Z"), tokyo, Yesterday, time.Monday, dates("2023-12-31", "2023-12-31")},
+		{fixed("2023-12-31T15:30:00Z"), tokyo, Week, time.Monday, dates("2023-12-25", "2023-12-31")},
+		{fixed("2023-12-31T15:30:00Z"), tokyo, Rolling(30), time.Monday, dates("2023-12-02", "2023-12-31")},
+		{fixed("2023-12-31T15:30:00Z"), tokyo, CalendarWeek, time.Monday, dates("2023-12-25", "2023-12-31")},
+		{fixed("2023-12-31T15:30:00Z"), tokyo, CalendarWeek, time.Sunday, dates("2023-12-24", "2023-12-30")},
+		{fixed("2023-12-31T15:30:00Z"), tokyo, Month, time.Monday, dates("2023-12-01", "2023-12-31")},
+		{fixed("2023-12-31T15:30:00Z"), tokyo, Quarter, time.Monday, dates("2023-10-01", "2023-12-31")},
+		{fixed("2023-12-31T15:30:00Z"), tokyo, MonthToDate, time.Monday, dates("2023-12-01", "2023-12-31")},
+		{fixed("2023-12-31T15:30:00Z"), tokyo, YearToDate, time.Monday, dates("2023-01-01", "2023-12-31")},
+
+		// 00:15 on March 1 of a leap year in Tokyo.
+		{fixed("2024-02-29T15:15:00Z"), tokyo, Month, time.Monday, dates("2024-02-01", "2024-02-29")},
+		{fixed("2024-02-29T15:15:00Z"), tokyo, MonthToDate, time.Monday, dates("2024-02-01", "2024-02-29")},
+		{fixed("2024-02-29T15:15:00Z"), tokyo, YearToDate, time.Monday, dates("2024-01-01", "2024-02-29")},
+	}
+	for _, tt := range tests {
+		now := tt.clock.Now().In(tt.loc)
+		if got := tt.period.Range(now, tt.weekStart); got != tt.want {
+			t.Errorf("%s at %v starting %v = %v, want %v", tt.period, now, tt.weekStart, got, tt.want)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		dates  DateRange
+		period Period
+		want   []DateRange
+	}{
+		{dates("2024-01-15", "2024-04-10"), Month, []DateRange{
+			dates("2024-01-15", "2024-01-31"),
+			dates("2024-02-01", "2024-02-29"),
+			dates("2024-03-01", "2024-03-31"),
+			dates("2024-04-01", "2024-04-10"),
+		}},
+		{dates("2024-01-03", "2024-01-16"), CalendarWeek, []DateRange{
+			dates("2024-01-03", "2024-01-07"),
+			dates("2024-01-08", "2024-01-14"),
+			dates("2024-01-15", "2024-01-16"),
+		}},
+		{dates("2024-01-03", "2024-01-16"), Week, []DateRange{
+			dates("2024-01-03", "2024-01-09"),
+			dates("2024-01-10", "2024-01-16"),
+		}},
+		{dates("2023-11-15", "2024-05-01"), Quarter, []DateRange{
+			dates("2023-11-15", "2023-12-31"),
+			dates("2024-01-01", "2024-03-31"),
+			dates("2024-04-01", "2024-05-01"),
+		}},
+		{dates("2023-12-30", "2024-01-01"), Yesterday, []DateRange{
+			dates("2023-12-30", "2023-12-30"),
+			dates("2023-12-31", "2023-12-31"),
+			dates("2024-01-01", "2024-01-01"),
+		}},
+		{dates("2023-12-15", "2024-02-10"), MonthToDate, []DateRange{
+			dates("2023-12-15", "2023-12-31"),
+			dates("2024-01-01", "2024-01-31"),
+			dates("2024-02-01", "2024-02-10"),
+		}},
+		{dates("2023-06-01", "2024-02-01"), YearToDate, []DateRange{
+			dates("2023-06-01", "2023-12-31"),
+			dates("2024-01-01", "2024-02-01"),
+		}},
+		{dates("2024-02-10", "2024-02-20"), Month, []DateRange{
+			dates("2024-02-10", "2024-02-20"),
+		}},
+	}
+	for _, tt := range tests {
+		if got := tt.dates.Split(tt.period, time.Monday); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v split by %s = %v, want %v", tt.dates, tt.period, got, tt.want)
+		}
+	}
+}
+
+func TestChunk(t *testing.T) {
+	tests := []struct {
+		dates DateRange
+		days  int
+		want  []DateRange
+	}{
+		{dates("2024-01-01", "2024-12-31"), maxReportDays, []DateRange{
+			dates("2024-01-01", "2024-07-04"),
+			dates("2024-07-05", "2024-12-31"),
+		}},
+		{dates("2024-01-01", "2024-01-10"), maxReportDays, []DateRange{
+			dates("2024-01-01", "2024-01-10"),
+		}},
+		{dates("2023-12-30", "2024-01-03"), 2, []DateRange{
+			dates("2023-12-30", "2023-12-31"),
+			dates("2024-01-01", "2024-01-02"),
+			dates("2024-01-03", "2024-01-03"),
+		}},
+	}
+	for _, tt := range tests {
+		if got := tt.dates.Chunk(tt.days); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v in chunks of %d = %v, want %v", tt.dates, tt.days, got, tt.want)
+		}
+	}
+}
+
+func TestStartOfWeek(t *testing.T) {
+	tests := []struct {
+		date      string
+		weekStart time.Weekday
+		want      string
+	}{
+		{"2024-01-01", time.Monday, "2024-01-01"},
+		{"2023-12-31", time.Monday, "2023-12-25"},
+		{"2023-12-31", time.Sunday, "2023-12-31"},
+		{"2024-01-06", time.Sunday, "2023-12-31"},
+		{"2024-01-03", time.Saturday, "2023-12-30"},
+	}
+	for _, tt := range tests {
+		if got := startOfWeek(day(tt.date), tt.weekStart); !got.Equal(day(tt.want)) {
+			t.Errorf("startOfWeek(%s, %v) = %s, want %s", tt.date, tt.weekStart, got.Format(dateLayout), tt.want)
+		}
+	}
+}
+
+func TestStartOfQuarter(t *testing.T) {
+	tests := []struct {
+		date, want string
+	}{
+		{"2024-01-01", "2024-01-01"},
+		{"2024-03-31", "2024-01-01"},
+		{"2024-04-01", "2024-04-01"},
+		{"2024-08-15", "2024-07-01"},
+		{"2024-12-31", "2024-10-01"},
+	}
+	for _, tt := range tests {
+		if got := startOfQuarter(day(tt.date)); !got.Equal(day(tt.want)) {
+			t.Errorf("startOfQuarter(%s) = %s, want %s", tt.date, got.Format(dateLayout), tt.want)
+		}
+	}
+}
+
+func TestRunRanges(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backfill := dates("2023-01-01", "2023-12-31")
+	tests := []struct {
+		run  Run
+		want []DateRange
+	}{
+		{Run{Period: Month, Clock: fixed("2023-12-31T15:30:00Z")}, []DateRange{
+			dates("2023-12-01", "2023-12-31"),
+		}},
+		{Run{Period: Quarter, Dates: &backfill, Backfill: true}, []DateRange{
+			dates("2023-01-01", "2023-03-31"),
+			dates("2023-04-01", "2023-06-30"),
+			dates("2023-07-01", "2023-09-30"),
+			dates("2023-10-01", "2023-12-31"),
+		}},
+		{Run{Period: Month, Dates: &backfill}, []DateRange{
+			dates("2023-01-01", "2023-07-05"),
+			dates("2023-07-06", "2023-12-31"),
+		}},
+	}
+	for _, tt := range tests {
+		if got := tt.run.Ranges(tt.run.Clock.Now().In(tokyo)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v ranges = %v, want %v", tt.run, got, tt.want)
+		}
+	}
+}
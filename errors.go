@@ -0,0 +1,109 @@
+package airpin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Errors that stop a run before anything is written to Airtable.  Use
+// errors.Is to check for them, e.g. errors.Is(err, ErrMissingColumn).
+var (
+	ErrMissingColumn = errors.New("missing column")
+	ErrParse         = errors.New("parse error")
+	ErrReportTimeout = errors.New("report timed out")
+	ErrReportFailed  = errors.New("report failed")
+	ErrAPI           = errors.New("API error")
+	ErrSchema        = errors.New("schema mismatch")
+)
+
+// An APIError is a response from Pinterest or Airtable whose status is not
+// 200 OK.  It matches ErrAPI with errors.Is.
+type APIError struct {
+	Method     string
+	URL        string
+	Status     string
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s %s: %s: %s", e.Method, e.URL, e.Status, e.Body)
+}
+
+func (e *APIError) Is(target error) bool {
+	return target == ErrAPI
+}
+
+// A ReportError is a report that Pinterest didn't finish.  It matches
+// ErrReportFailed with errors.Is if the status is FAILED, EXPIRED, CANCELLED
+// or DOES_NOT_EXIST, and ErrReportTimeout otherwise.
+type ReportError struct {
+	Account string
+	Token   string
+	Status  string
+	Waited  time.Duration
+}
+
+func (e *ReportError) Error() string {
+	if e.timeout() {
+		return fmt.Sprintf("%v after %v: account %s, token %s, status %s",
+			ErrReportTimeout, e.Waited.Round(time.Second), e.Account, e.Token, e.Status)
+	}
+	return fmt.Sprintf("%v: account %s, token %s, status %s",
+		ErrReportFailed, e.Account, e.Token, e.Status)
+}
+
+func (e *ReportError) Is(target error) bool {
+	if e.timeout() {
+		return target == ErrReportTimeout
+	}
+	return target == ErrReportFailed
+}
+
+func (e *ReportError) timeout() bool {
+	switch e.Status {
+	case "FAILED", "EXPIRED", "CANCELLED", "DOES_NOT_EXIST":
+		return false
+	}
+	return true
+}
+
+// A BatchError is a request to create records in Airtable that failed, with
+// the IDs of the campaigns whose records weren't written.
+type BatchError struct {
+	CampaignIDs []string
+	Err         error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("campaigns %s: %v", strings.Join(e.CampaignIDs, ", "), e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// A SchemaError is a field that Airpin writes which is missing from a table,
+// or has the wrong type.  It matches ErrSchema with errors.Is.
+type SchemaError struct {
+	Table string
+	Field string
+	Want  FieldType
+	Got   string
+}
+
+func (e *SchemaError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("%v: %s: no such table", ErrSchema, e.Table)
+	}
+	if e.Got == "" {
+		return fmt.Sprintf("%v: %s: no field %q (%s)", ErrSchema, e.Table, e.Field, e.Want)
+	}
+	return fmt.Sprintf("%v: %s: field %q is %s, not %s", ErrSchema, e.Table, e.Field, e.Got, e.Want)
+}
+
+func (e *SchemaError) Is(target error) bool {
+	return target == ErrSchema
+}
@@ -0,0 +1,322 @@
+package airpin
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Expressions define the metrics that are in v4 of the Pinterest API but not
+// v5, e.g. "SPEND_IN_MICRO_DOLLAR / (OUTBOUND_CLICK_1 + OUTBOUND_CLICK_2)".
+// They support numbers (with an optional exponent), Pinterest column names,
+// + - * / and parentheses, with the usual precedence.
+type Expr struct {
+	src  string
+	root node
+}
+
+// What to do when a division by zero, NaN or infinity occurs.  "zero"
+// replaces the value with 0, "null" clears the Airtable field and "error"
+// fails the run.
+type Policy struct {
+	DivZero string `json:"div_zero,omitempty"`
+	NaN     string `json:"nan,omitempty"`
+	Inf     string `json:"inf,omitempty"`
+}
+
+const (
+	policyZero  = "zero"
+	policyNull  = "null"
+	policyError = "error"
+)
+
+// The policy for fields that don't set one.  Division by zero and infinity
+// were previously written as 0, so they still are.
+var defaultPolicy = Policy{DivZero: policyZero, NaN: policyError, Inf: policyZero}
+
+var (
+	errNull    = errors.New("null")
+	errDivZero = errors.New("division by zero")
+)
+
+// Fill in the unset parts of p from q.
+func (p Policy) or(q Policy) Policy {
+	if p.DivZero == "" {
+		p.DivZero = q.DivZero
+	}
+	if p.NaN == "" {
+		p.NaN = q.NaN
+	}
+	if p.Inf == "" {
+		p.Inf = q.Inf
+	}
+	return p
+}
+
+func (p Policy) validate() error {
+	for _, v := range []string{p.DivZero, p.NaN, p.Inf} {
+		switch v {
+		case "", policyZero, policyNull, policyError:
+		default:
+			return fmt.Errorf("invalid policy %q", v)
+		}
+	}
+	return nil
+}
+
+// Apply the NaN and Inf policies to v.  The error is errNull when the field
+// should be null.
+func (p Policy) check(v float64) (float64, error) {
+	var action string
+	switch {
+	case math.IsNaN(v):
+		action = p.NaN
+	case math.IsInf(v, 0):
+		action = p.Inf
+	default:
+		return v, nil
+	}
+	switch action {
+	case policyZero:
+		return 0, nil
+	case policyNull:
+		return 0, errNull
+	}
+	return 0, fmt.Errorf("value is %v", v)
+}
+
+func ParseExpr(src string) (*Expr, error) {
+	p := parser{tokens: tokenize(src)}
+	root, err := p.expr()
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", src, err)
+	}
+	if t := p.peek(); t != "" {
+		return nil, fmt.Errorf("%q: unexpected %q", src, t)
+	}
+	return &Expr{src, root}, nil
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+// The names the expression refers to, in order of first appearance.
+func (e *Expr) Names() []string {
+	var names []string
+	seen := map[string]bool{}
+	e.root.names(func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	})
+	return names
+}
+
+// Evaluate the expression, looking up names with vars.  The error is errNull
+// when the policy says the result should be null.
+func (e *Expr) Eval(vars func(string) (float64, error), p Policy) (float64, error) {
+	v, err := e.root.eval(vars, p)
+	if err != nil {
+		return 0, err
+	}
+	return p.check(v)
+}
+
+type node interface {
+	eval(vars func(string) (float64, error), p Policy) (float64, error)
+	names(func(string))
+}
+
+type number float64
+
+func (n number) eval(func(string) (float64, error), Policy) (float64, error) {
+	return float64(n), nil
+}
+
+func (n number) names(func(string)) {}
+
+type name string
+
+func (n name) eval(vars func(string) (float64, error), p Policy) (float64, error) {
+	return vars(string(n))
+}
+
+func (n name) names(f func(string)) {
+	f(string(n))
+}
+
+type negate struct {
+	x node
+}
+
+func (n negate) eval(vars func(string) (float64, error), p Policy) (float64, error) {
+	x, err := n.x.eval(vars, p)
+	return -x, err
+}
+
+func (n negate) names(f func(string)) {
+	n.x.names(f)
+}
+
+type binary struct {
+	op   byte
+	x, y node
+}
+
+func (b binary) eval(vars func(string) (float64, error), p Policy) (float64, error) {
+	x, err := b.x.eval(vars, p)
+	if err != nil {
+		return 0, err
+	}
+	y, err := b.y.eval(vars, p)
+	if err != nil {
+		return 0, err
+	}
+	switch b.op {
+	case '+':
+		return x + y, nil
+	case '-':
+		return x - y, nil
+	case '*':
+		return x * y, nil
+	}
+	if y == 0 {
+		switch p.DivZero {
+		case policyZero:
+			return 0, nil
+		case policyNull:
+			return 0, errNull
+		}
+		return 0, errDivZero
+	}
+	return x / y, nil
+}
+
+func (b binary) names(f func(string)) {
+	b.x.names(f)
+	b.y.names(f)
+}
+
+// Split the source into numbers, names, operators and parentheses.  Anything
+// else is returned as a single-character token for the parser to reject.
+// Numbers may have an exponent, e.g. 1e-5.
+func tokenize(src string) []string {
+	var tokens []string
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case isNameChar(c) || c == '.':
+			number := '0' <= c && c <= '9' || c == '.'
+			j := i
+			for j < len(src) && (isNameChar(src[j]) || src[j] == '.') {
+				if number && (src[j] == 'e' || src[j] == 'E') && j+1 < len(src) && (src[j+1] == '+' || src[j+1] == '-') {
+					j++
+				}
+				j++
+			}
+			tokens = append(tokens, src[i:j])
+			i = j
+		default:
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+	return tokens
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9'
+}
+
+// A recursive descent parser for the grammar
+//
+//	expr   = term { ("+" | "-") term }
+//	term   = factor { ("*" | "/") factor }
+//	factor = "-" factor | "(" expr ")" | number | name
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *parser) expr() (node, error) {
+	x, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t == "+" || t == "-"; t = p.peek() {
+		p.next()
+		y, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		x = binary{t[0], x, y}
+	}
+	return x, nil
+}
+
+func (p *parser) term() (node, error) {
+	x, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for t := p.peek(); t == "*" || t == "/"; t = p.peek() {
+		p.next()
+		y, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		x = binary{t[0], x, y}
+	}
+	return x, nil
+}
+
+func (p *parser) factor() (node, error) {
+	t := p.next()
+	switch {
+	case t == "":
+		return nil, errors.New("unexpected end of expression")
+	case t == "-":
+		x, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		return negate{x}, nil
+	case t == "(":
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if t := p.next(); t != ")" {
+			return nil, fmt.Errorf("expected \")\", got %q", t)
+		}
+		return x, nil
+	case '0' <= t[0] && t[0] <= '9' || t[0] == '.':
+		n, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", t)
+		}
+		return number(n), nil
+	case isNameChar(t[0]) && !strings.Contains(t, "."):
+		return name(t), nil
+	}
+	return nil, fmt.Errorf("unexpected %q", t)
+}
@@ -0,0 +1,184 @@
+package airpin
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func vars(values map[string]float64) func(string) (float64, error) {
+	return func(name string) (float64, error) {
+		v, ok := values[name]
+		if !ok {
+			return 0, errors.New("unknown " + name)
+		}
+		return v, nil
+	}
+}
+
+func TestEval(t *testing.T) {
+	values := map[string]float64{"a": 10, "b": 4, "c": 2}
+	tests := []struct {
+		src  string
+		want float64
+	}{
+		{"a - b - c", 4},
+		{"a / b / 100", 0.025},
+		{"a + b * c", 18},
+		{"a * b + c", 42},
+		{"a - b + c", 8},
+		{"a / c * b", 20},
+		{"(a + b) * c", 28},
+		{"a * (b - c)", 20},
+		{"((a))", 10},
+		{"-a + b", -6},
+		{"-(a + b)", -14},
+		{"a - -b", 14},
+		{"--a", 10},
+		{"-a * -c", 20},
+		{"1.5 * c", 3},
+		{".5 * a", 5},
+		{"1e-5 * a", 1e-4},
+		{"2E+2 + 1e2", 300},
+		{"a*b-c", 38},
+	}
+	for _, tt := range tests {
+		e, err := ParseExpr(tt.src)
+		if err != nil {
+			t.Errorf("ParseExpr(%q): %v", tt.src, err)
+			continue
+		}
+		got, err := e.Eval(vars(values), defaultPolicy)
+		if err != nil {
+			t.Errorf("%q: %v", tt.src, err)
+			continue
+		}
+		if math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("%q = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"", "unexpected end"},
+		{"a +", "unexpected end"},
+		{"(a", `expected ")"`},
+		{"a)", `unexpected ")"`},
+		{"1.2.3", `invalid number "1.2.3"`},
+		{"a.b", `unexpected "a.b"`},
+		{"a b", `unexpected "b"`},
+		{"a % b", `unexpected "%"`},
+		{"1e", `invalid number "1e"`},
+		{"1e-", `invalid number "1e-"`},
+		{"1e-x", `invalid number "1e-x"`},
+		{"* a", `unexpected "*"`},
+	}
+	for _, tt := range tests {
+		_, err := ParseExpr(tt.src)
+		if err == nil {
+			t.Errorf("ParseExpr(%q) succeeded, want an error", tt.src)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("ParseExpr(%q): %v, want %s", tt.src, err, tt.want)
+		}
+	}
+}
+
+func TestEvalPolicy(t *testing.T) {
+	values := map[string]float64{"a": 1, "zero": 0, "nan": math.NaN(), "inf": math.Inf(1)}
+	tests := []struct {
+		src     string
+		policy  Policy
+		want    float64
+		wantErr error
+	}{
+		{"a / zero", Policy{DivZero: policyZero}, 0, nil},
+		{"a / zero", Policy{DivZero: policyNull}, 0, errNull},
+		{"a / zero", Policy{DivZero: policyError}, 0, errDivZero},
+		{"zero / zero", Policy{DivZero: policyZero, NaN: policyError}, 0, nil},
+		{"nan + a", Policy{NaN: policyZero}, 0, nil},
+		{"nan + a", Policy{NaN: policyNull}, 0, errNull},
+		{"nan + a", Policy{NaN: policyError}, 0, errors.New("value is NaN")},
+		{"inf - a", Policy{Inf: policyZero}, 0, nil},
+		{"inf - a", Policy{Inf: policyNull}, 0, errNull},
+		{"-inf", Policy{Inf: policyError}, 0, errors.New("value is -Inf")},
+		{"a / 1e-320 / 1e-320", Policy{Inf: policyNull}, 0, errNull},
+		{"a / 2", Policy{DivZero: policyError, NaN: policyError, Inf: policyError}, 0.5, nil},
+	}
+	for _, tt := range tests {
+		e, err := ParseExpr(tt.src)
+		if err != nil {
+			t.Fatalf("ParseExpr(%q): %v", tt.src, err)
+		}
+		got, err := e.Eval(vars(values), tt.policy)
+		switch {
+		case tt.wantErr == nil && err != nil:
+			t.Errorf("%q with %+v: %v", tt.src, tt.policy, err)
+		case tt.wantErr == errNull || tt.wantErr == errDivZero:
+			if err != tt.wantErr {
+				t.Errorf("%q with %+v: error %v, want %v", tt.src, tt.policy, err, tt.wantErr)
+			}
+		case tt.wantErr != nil:
+			if err == nil || err.Error() != tt.wantErr.Error() {
+				t.Errorf("%q with %+v: error %v, want %v", tt.src, tt.policy, err, tt.wantErr)
+			}
+		case got != tt.want:
+			t.Errorf("%q with %+v = %v, want %v", tt.src, tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestNames(t *testing.T) {
+	e, err := ParseExpr("b * (a + c) / b - -d + a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"b", "a", "c", "d"}
+	if got := e.Names(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Names() = %v, want %v", got, want)
+	}
+	e, err = ParseExpr("1 + 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := e.Names(); len(got) != 0 {
+		t.Errorf("Names() = %v, want none", got)
+	}
+}
+
+func TestMappingCycle(t *testing.T) {
+	tests := []struct {
+		derived string
+		cycle   bool
+	}{
+		{`{"A": "B + 1", "B": "C * 2"}`, false},
+		{`{"A": "B + C", "B": "C", "C": "D"}`, false},
+		{`{"A": "A + 1"}`, true},
+		{`{"A": "B + 1", "B": "A * 2"}`, true},
+		{`{"A": "B", "B": "C", "C": "D / A"}`, true},
+	}
+	for _, tt := range tests {
+		panicked := func() (panicked bool) {
+			defer func() {
+				if r := recover(); r != nil {
+					if !strings.Contains(r.(string), "refers to itself") {
+						t.Errorf("%s: panic %v", tt.derived, r)
+					}
+					panicked = true
+				}
+			}()
+			newMapping([]byte(`{"derived": ` + tt.derived + `, "fields": []}`))
+			return false
+		}()
+		if panicked != tt.cycle {
+			t.Errorf("%s: panicked %v, want %v", tt.derived, panicked, tt.cycle)
+		}
+	}
+}
@@ -5,6 +5,8 @@ import (
 	_ "embed"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"strings"
 
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
 	"github.com/caarlos0/env/v8"
@@ -16,6 +18,28 @@ type Credentials struct {
 	PinterestToken string `env:"PINTEREST_TOKEN,required"`
 }
 
+// Config is read from the environment at the start of each run.  Clients is
+// where to load the clients from (see LoadClients).  Preflight checks the
+// tables' fields before anything is fetched (see Airtable.Preflight).
+// WeekStart is the first day of calendar weeks, e.g. "sunday".  Concurrency
+// is how many reports are requested and downloaded at once, and
+// WriteConcurrency how many tables are written at once.  DryRun renders the
+// requests to Airtable instead of sending them (see Run), to stdout or to
+// files in DryRunDir.
+type Config struct {
+	Credentials
+	Polling
+	Clients          string `env:"CLIENTS" envDefault:"clients.json"`
+	Preflight        bool   `env:"PREFLIGHT" envDefault:"true"`
+	WeekStart        string `env:"WEEK_START" envDefault:"monday"`
+	Concurrency      int    `env:"CONCURRENCY" envDefault:"8"`
+	WriteConcurrency int    `env:"WRITE_CONCURRENCY" envDefault:"4"`
+	DryRun           bool   `env:"DRY_RUN"`
+	DryRunDir        string `env:"DRY_RUN_DIR"`
+	AirtableRetry    Retry  `envPrefix:"AIRTABLE_"`
+	PinterestRetry   Retry  `envPrefix:"PINTEREST_"`
+}
+
 type data struct {
 	Message struct {
 		Data string
@@ -27,37 +51,44 @@ func init() {
 }
 
 func airpin(ctx context.Context, e event.Event) error {
-	period := getPeriod(e)
-	creds := Credentials{}
-	if err := env.Parse(&creds); err != nil {
-		panic(err)
+	run, err := getRun(e)
+	if err != nil {
+		return err
 	}
-	pin := NewPinterest(creds.PinterestToken, period)
-	air := NewAirtable(creds.AirtableToken, period)
-
-	for account_id := range bases {
-		air.Update(account_id, pin.Reports(account_id))
+	conf := Config{}
+	if err := env.Parse(&conf); err != nil {
+		return err
 	}
-
-	return nil
+	if err := run.Configure(conf); err != nil {
+		return err
+	}
+	summary, err := run.Do(ctx, conf)
+	summary.log()
+	return err
 }
 
-func getPeriod(e event.Event) Period {
+// The message is either the name of a period, e.g. "7-day", or RunOptions as
+// JSON, e.g. {"period": "month", "start": "2024-01-01", "end": "2024-06-30",
+// "backfill": true, "accounts": ["549756012345"], "dry_run": true,
+// "granularity": "DAY"}, all of which are optional.  The period defaults to
+// 7-day (see Period for the others).
+func getRun(e event.Event) (Run, error) {
 	var d data
-	json.Unmarshal(e.Data(), &d)
+	if err := json.Unmarshal(e.Data(), &d); err != nil {
+		return Run{}, fmt.Errorf("%w: event data: %v", ErrParse, err)
+	}
 	data, err := base64.StdEncoding.DecodeString(d.Message.Data)
 	if err != nil {
-		panic(err)
+		return Run{}, fmt.Errorf("%w: message data: %v", ErrParse, err)
 	}
 
-	var period Period
-	switch string(data) {
-	case "7-day":
-		period = Week
-	case "month":
-		period = Month
-	default:
-		panic("invalid period")
+	if !strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		period, err := parsePeriod(string(data))
+		return Run{Period: period}, err
+	}
+	opts := RunOptions{Period: Week}
+	if err := json.Unmarshal(data, &opts); err != nil {
+		return Run{}, fmt.Errorf("%w: message: %v", ErrParse, err)
 	}
-	return period
+	return opts.Run()
 }
@@ -0,0 +1,77 @@
+package airpin
+
+import (
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/cloudevents/sdk-go/v2/event"
+)
+
+// A Pub/Sub event with the message.
+func pubsub(t *testing.T, message string) event.Event {
+	t.Helper()
+	e := event.New()
+	data := `{"message": {"data": "` + base64.StdEncoding.EncodeToString([]byte(message)) + `"}}`
+	if err := e.SetData(event.ApplicationJSON, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestGetRun(t *testing.T) {
+	backfill := dates("2024-01-01", "2024-06-30")
+	tests := []struct {
+		message string
+		want    Run
+	}{
+		{"7-day", Run{Period: Week}},
+		{"month", Run{Period: Month}},
+		{"30-day", Run{Period: Rolling(30)}},
+		{"ytd", Run{Period: YearToDate}},
+		{`{}`, Run{Period: Week}},
+		{` {"period": "quarter"}`, Run{Period: Quarter}},
+		{`{"period": "month", "start": "2024-01-01", "end": "2024-06-30", "backfill": true}`,
+			Run{Period: Month, Dates: &backfill, Backfill: true}},
+		{`{"accounts": ["549756012345"], "dry_run": true, "granularity": "DAY"}`,
+			Run{Period: Week, Accounts: []string{"549756012345"}, DryRun: true, Report: ReportOptions{Granularity: "DAY"}}},
+	}
+	for _, tt := range tests {
+		got, err := getRun(pubsub(t, tt.message))
+		if err != nil {
+			t.Errorf("%s: %v", tt.message, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %+v, want %+v", tt.message, got, tt.want)
+		}
+	}
+}
+
+func TestGetRunErrors(t *testing.T) {
+	for _, message := range []string{
+		"",
+		"fortnight",
+		"0-day",
+		"187-day",
+		`{"period": "fortnight"}`,
+		`{"period": "month"`,
+		`{"start": "2024-01-01"}`,
+		`{"start": "2024-06-30", "end": "2024-01-01"}`,
+		`{"backfill": true}`,
+		`{"granularity": "HOUR"}`,
+	} {
+		if _, err := getRun(pubsub(t, message)); !errors.Is(err, ErrParse) {
+			t.Errorf("%q: %v, want ErrParse", message, err)
+		}
+	}
+
+	e := event.New()
+	if err := e.SetData(event.ApplicationJSON, []byte(`{"message": {"data": "not base64!"}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getRun(e); !errors.Is(err, ErrParse) {
+		t.Errorf("invalid base64: %v, want ErrParse", err)
+	}
+}
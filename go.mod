@@ -3,9 +3,11 @@ module fuzzytuxedomedia.com/airpin
 go 1.20
 
 require (
+	cloud.google.com/go/secretmanager v1.11.1
 	github.com/GoogleCloudPlatform/functions-framework-go v1.7.4
 	github.com/caarlos0/env/v8 v8.0.0
 	github.com/cloudevents/sdk-go/v2 v2.14.0
+	golang.org/x/oauth2 v0.8.0
 )
 
 require (
@@ -13,7 +15,6 @@ require (
 	cloud.google.com/go/compute/metadata v0.2.3 // indirect
 	cloud.google.com/go/functions v1.15.1 // indirect
 	cloud.google.com/go/iam v1.1.1 // indirect
-	cloud.google.com/go/secretmanager v1.11.1 // indirect
 	github.com/golang/groupcache v0.0.0-20210331224755-41bb18bfe9da // indirect
 	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/google/go-cmp v0.5.9 // indirect
@@ -30,7 +31,6 @@ require (
 	go.uber.org/zap v1.10.0 // indirect
 	golang.org/x/crypto v0.9.0 // indirect
 	golang.org/x/net v0.10.0 // indirect
-	golang.org/x/oauth2 v0.8.0 // indirect
 	golang.org/x/sync v0.2.0 // indirect
 	golang.org/x/sys v0.8.0 // indirect
 	golang.org/x/text v0.9.0 // indirect
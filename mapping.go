@@ -0,0 +1,209 @@
+package airpin
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+)
+
+// The Airtable fields of the Ad KPIs table and where their values come from.
+// When the Pinterest report template changes, update this file to match.
+//
+//go:embed "mapping.json"
+var mappingJson []byte
+
+type FieldType string
+
+const (
+	Int      FieldType = "int"
+	Float    FieldType = "float"
+	Currency FieldType = "currency"
+	Percent  FieldType = "percent"
+	String   FieldType = "string"
+
+	// Only for the fields Airpin adds itself (Report Date, Start and End).
+	Date FieldType = "date"
+)
+
+// A Field is an Airtable field whose value is either copied from a Pinterest
+// column or calculated by a formula.  Formulas are expressions (see expr.go)
+// over Pinterest columns and the derived metrics in the mapping.  Round is the
+// number of decimal places for float types; when it's omitted, the value is
+// not rounded.  Policy overrides the mapping's policy for this field.
+type Field struct {
+	Name    string    `json:"name"`
+	Column  string    `json:"column,omitempty"`
+	Formula string    `json:"formula,omitempty"`
+	Type    FieldType `json:"type"`
+	Round   *int      `json:"round,omitempty"`
+	Policy  Policy    `json:"policy"`
+	expr    *Expr
+}
+
+// Derived maps the names of metrics which are in v4 of the Pinterest API but
+// not v5 to the expressions that calculate them, so that formulas can refer
+// to them like any other column.
+type Mapping struct {
+	Policy  Policy            `json:"policy"`
+	Derived map[string]string `json:"derived"`
+	Fields  []Field           `json:"fields"`
+	derived map[string]*Expr
+}
+
+var mapping = newMapping(mappingJson)
+
+// Panic on an invalid mapping, since it's embedded and must never be deployed.
+func newMapping(data []byte) Mapping {
+	var m Mapping
+	if err := json.Unmarshal(data, &m); err != nil {
+		panic(err)
+	}
+	if err := m.Policy.validate(); err != nil {
+		panic(err)
+	}
+	m.Policy = m.Policy.or(defaultPolicy)
+
+	m.derived = make(map[string]*Expr, len(m.Derived))
+	for name, src := range m.Derived {
+		e, err := ParseExpr(src)
+		if err != nil {
+			panic("derived " + name + ": " + err.Error())
+		}
+		m.derived[name] = e
+	}
+	for name := range m.derived {
+		m.checkCycle(name, nil)
+	}
+
+	for i := range m.Fields {
+		f := &m.Fields[i]
+		if (f.Column == "") == (f.Formula == "") {
+			panic("field " + f.Name + ": exactly one of column or formula is required")
+		}
+		switch f.Type {
+		case Int, Float, Currency, Percent:
+		case String:
+			if f.Formula != "" {
+				panic("field " + f.Name + ": a string can't be a formula")
+			}
+		default:
+			panic("field " + f.Name + ": unknown type " + string(f.Type))
+		}
+		if err := f.Policy.validate(); err != nil {
+			panic("field " + f.Name + ": " + err.Error())
+		}
+		f.Policy = f.Policy.or(m.Policy)
+		if f.Formula != "" {
+			e, err := ParseExpr(f.Formula)
+			if err != nil {
+				panic("field " + f.Name + ": " + err.Error())
+			}
+			f.expr = e
+		}
+	}
+	return m
+}
+
+// Panic if the derived metric refers to itself, directly or indirectly.
+func (m Mapping) checkCycle(name string, path []string) {
+	for _, p := range path {
+		if p == name {
+			panic("derived " + name + " refers to itself")
+		}
+	}
+	if e, ok := m.derived[name]; ok {
+		for _, n := range e.Names() {
+			m.checkCycle(n, append(path, name))
+		}
+	}
+}
+
+// The Pinterest columns that the mapping reads, all of which must appear in
+// the header of the report.
+func (m Mapping) Columns() []string {
+	var columns []string
+	seen := map[string]bool{}
+	var add func(string)
+	add = func(c string) {
+		if e, ok := m.derived[c]; ok {
+			for _, n := range e.Names() {
+				add(n)
+			}
+		} else if !seen[c] {
+			seen[c] = true
+			columns = append(columns, c)
+		}
+	}
+	for _, f := range m.Fields {
+		if f.expr != nil {
+			for _, n := range f.expr.Names() {
+				add(n)
+			}
+		} else {
+			add(f.Column)
+		}
+	}
+	return columns
+}
+
+// The Airtable fields for a row, keyed by field name.
+func (m Mapping) Values(row Row) (map[string]any, error) {
+	values := make(map[string]any, len(m.Fields))
+	for _, f := range m.Fields {
+		v, err := m.value(f, row)
+		if err == errNull {
+			values[f.Name] = nil
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %w", f.Name, err)
+		}
+		values[f.Name] = v
+	}
+	return values, nil
+}
+
+func (m Mapping) value(f Field, row Row) (any, error) {
+	if f.Type == String {
+		return row[f.Column], nil
+	}
+	if f.Type == Int && f.Column != "" {
+		return row.atoi(f.Column)
+	}
+
+	var v float64
+	var err error
+	if f.expr != nil {
+		v, err = f.expr.Eval(m.vars(row, f.Policy), f.Policy)
+	} else {
+		var n JSONFloat
+		if n, err = row.parseFloat(f.Column); err == nil {
+			v, err = f.Policy.check(float64(n))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f.Type == Int {
+		return int(v), nil
+	}
+	if f.Round != nil {
+		p := math.Pow10(*f.Round)
+		v = math.Round(v*p) / p
+	}
+	return JSONFloat(v), nil
+}
+
+// Look up names in the row, calculating derived metrics as needed.
+func (m Mapping) vars(row Row, p Policy) func(string) (float64, error) {
+	var vars func(string) (float64, error)
+	vars = func(name string) (float64, error) {
+		if e, ok := m.derived[name]; ok {
+			return e.Eval(vars, p)
+		}
+		n, err := row.parseFloat(name)
+		return float64(n), err
+	}
+	return vars
+}
@@ -2,4 +2,4 @@
 # Get metrics definitions JSON from Pinterest
 curl -X GET https://api.pinterest.com/v5/resources/delivery_metrics\?report_type=ASYNC \
   --header "Authorization: Bearer ${PINTEREST_TOKEN}" \
-  | jq . > metrics.json
+  | jq . > cmd/airpin/metrics.json
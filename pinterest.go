@@ -1,134 +1,305 @@
 package airpin
 
 import (
-	_ "embed"
+	"bytes"
+	"context"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
-	"strings"
+	"strconv"
+	"sync/atomic"
 	"time"
 )
 
-type Period int
+type Pinterest struct {
+	token   string
+	client  *http.Client
+	base    string
+	polling Polling
+	retry   Retry
+	retries *atomic.Int64
+}
 
-const (
-	Week = iota
-	Month
-)
+// Polling controls how long to wait for a report.  The interval between polls
+// starts at 1 second and doubles up to MaxInterval, with up to Jitter added to
+// each, until the report is ready or MaxWait has elapsed.
+type Polling struct {
+	MaxWait     time.Duration `env:"POLL_MAX_WAIT" envDefault:"2m"`
+	MaxInterval time.Duration `env:"POLL_MAX_INTERVAL" envDefault:"30s"`
+	Jitter      time.Duration `env:"POLL_JITTER" envDefault:"1s"`
+}
 
-type Pinterest struct {
-	token  string
-	client *http.Client
-	base   string
-	period Period
+func NewPinterest(token string, polling Polling, retry Retry) *Pinterest {
+	root := "https://api.pinterest.com/v5/"
+	return &Pinterest{token, &http.Client{}, root, polling, retry, &atomic.Int64{}}
 }
 
-func NewPinterest(token string, period Period) *Pinterest {
-	root := "https://api.pinterest.com/v5/ad_accounts/"
-	return &Pinterest{token, &http.Client{}, root, period}
+// The number of requests that have been retried.
+func (p Pinterest) Retries() int64 {
+	return p.retries.Load()
 }
 
-func (p Pinterest) get(path string) *http.Request {
-	req, err := http.NewRequest("GET", p.base+path, nil)
+func (p Pinterest) get(ctx context.Context, path string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.base+path, nil)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	req.Header.Add("Authorization", "Bearer "+p.token)
-	return req
+	return req, nil
 }
 
-func (p Pinterest) post(path string, body io.Reader) *http.Request {
-	req, err := http.NewRequest("POST", p.base+path, body)
+func (p Pinterest) post(ctx context.Context, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", p.base+path, body)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	req.Header.Add("Authorization", "Bearer "+p.token)
 	req.Header.Add("Content-Type", "application/json")
-	return req
+	return req, nil
 }
 
-func (p Pinterest) do(req *http.Request) io.ReadCloser {
-	res, err := p.client.Do(req)
-	if err != nil {
-		panic(err)
+// Send the request, retrying when it fails in a way that might not happen
+// again.  GETs are retried after network errors, 429 and 5xx.  Requesting a
+// report (POST) is only retried when Pinterest says it didn't process it (429
+// or 503), since otherwise we might request the same report twice.  The wait
+// before a retry honors Retry-After and the x-ratelimit-* headers; when that's
+// longer than the context has left, the request fails rather than sleeping
+// until it times out.
+func (p Pinterest) do(req *http.Request) (io.ReadCloser, error) {
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		wait := p.retry.backoff(attempt)
+		res, err := p.client.Do(req)
+		switch {
+		case err != nil:
+			if req.Context().Err() != nil {
+				return nil, err
+			}
+			retry = req.Method == "GET"
+		case res.StatusCode == http.StatusOK:
+			return res.Body, nil
+		default:
+			body, readErr := io.ReadAll(res.Body)
+			res.Body.Close()
+			if readErr != nil {
+				return nil, readErr
+			}
+			err = &APIError{req.Method, req.URL.String(), res.Status, res.StatusCode, string(body)}
+			retry = retryable(req.Method, res.StatusCode)
+			wait = retryAfter(res.Header, wait)
+		}
+		if !retry || attempt >= p.retry.Attempts {
+			return nil, err
+		}
+		if deadline, ok := req.Context().Deadline(); ok && time.Until(deadline) < wait {
+			return nil, fmt.Errorf("%w; not retrying after %v, past the deadline", err, wait.Round(time.Second))
+		}
+
+		p.retries.Add(1)
+		log.Printf("pinterest: %s %s%s: %v; retry %d of %d after %v",
+			req.Method, req.URL.Host, req.URL.Path, statusOrError(res, err),
+			attempt, p.retry.Attempts-1, wait)
+		if err := sleep(req.Context(), wait); err != nil {
+			return nil, err
+		}
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
 	}
-	if res.StatusCode != http.StatusOK {
-		body, err := io.ReadAll(res.Body)
-		if err != nil {
-			panic(err) // don't recover; log and notify
+}
+
+func retryable(method string, status int) bool {
+	if method != "GET" {
+		return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+	}
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// How long Pinterest asks us to wait before retrying, or backoff if it
+// doesn't say.  Retry-After is either seconds or a date.  When the rate limit
+// has been used up, x-ratelimit-reset is the seconds until it resets.
+func retryAfter(h http.Header, backoff time.Duration) time.Duration {
+	if v := h.Get("Retry-After"); v != "" {
+		if s, err := strconv.Atoi(v); err == nil {
+			return time.Duration(s) * time.Second
 		}
-		panic(res.Status + ": " + string(body))
+		if t, err := http.ParseTime(v); err == nil {
+			if d := time.Until(t); d > 0 {
+				return d
+			}
+			return 0
+		}
+	}
+	if h.Get("x-ratelimit-remaining") == "0" {
+		if s, err := strconv.Atoi(h.Get("x-ratelimit-reset")); err == nil {
+			return time.Duration(s) * time.Second
+		}
+	}
+	return backoff
+}
+
+func statusOrError(res *http.Response, err error) string {
+	if res != nil {
+		return res.Status
 	}
-	return res.Body
+	return err.Error()
 }
 
-func (p Pinterest) Reports(account_id string) [][]string {
-	token := p.requestReport(account_id)
-	url := p.waitForReport(account_id, token)
-	return p.getRecords(url)
+// Wait for the requested report, with the granularity it was requested with,
+// and download its rows.
+func (p Pinterest) report(ctx context.Context, account_id, token, granularity string) ([]Row, error) {
+	url, err := p.waitForReport(ctx, account_id, token)
+	if err != nil {
+		return nil, err
+	}
+	records, err := p.getRecords(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	return newRows(records, granularity)
 }
 
-//go:embed "config.json"
-var cfg string
+// An AdAccount is a Pinterest ad account.  TimeZone is the IANA name of the
+// timezone its reports are in, e.g. "America/New_York".
+type AdAccount struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	TimeZone string `json:"time_zone"`
+}
+
+func (p Pinterest) AdAccount(ctx context.Context, account_id string) (AdAccount, error) {
+	var a AdAccount
+	req, err := p.get(ctx, "ad_accounts/"+account_id)
+	if err != nil {
+		return a, err
+	}
+	res, err := p.do(req)
+	if err != nil {
+		return a, err
+	}
+	defer res.Close()
 
-func (p Pinterest) requestReport(account_id string) string {
-	var start_date, end_date string
-	switch p.period {
-	case Week:
-		start_date = formatDaysAgo(7)
-		end_date = formatDaysAgo(1)
-	case Month:
-		y, m, _ := time.Now().Date()
-		_, m, d := time.Date(y, m, 0, 0, 0, 0, 0, time.UTC).Date()
-		start_date = fmt.Sprintf("%v-%02d-01", y, int(m))
-		end_date = fmt.Sprintf("%v-%02d-%v", y, int(m), d)
+	if err := json.NewDecoder(res).Decode(&a); err != nil {
+		return a, fmt.Errorf("%w: ad account: %v", ErrParse, err)
 	}
-	path := fmt.Sprintf("%s/reports", account_id)
-	cfg = strings.Replace(cfg, "<START_DATE>", start_date, 1)
-	cfg = strings.Replace(cfg, "<END_DATE>", end_date, 1)
-	reader := strings.NewReader(cfg)
-	req := p.post(path, reader)
-	res := p.do(req)
+	return a, nil
+}
 
-	dec := json.NewDecoder(res)
-	var objmap map[string]interface{}
-	if err := dec.Decode(&objmap); err != nil {
-		panic(err)
+// The account's report templates, as Pinterest returns them.  config.json is
+// kept in step with one of them by hand.
+func (p Pinterest) Templates(ctx context.Context, account_id string) (json.RawMessage, error) {
+	return p.raw(ctx, "ad_accounts/"+account_id+"/templates")
+}
+
+// Pinterest's definitions of the columns of async reports, as in
+// metrics.json.
+func (p Pinterest) Metrics(ctx context.Context) (json.RawMessage, error) {
+	return p.raw(ctx, "resources/delivery_metrics?report_type=ASYNC")
+}
+
+func (p Pinterest) raw(ctx context.Context, path string) (json.RawMessage, error) {
+	req, err := p.get(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	res, err := p.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	data, err := io.ReadAll(res)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("%w: %s: invalid JSON", ErrParse, path)
+	}
+	return data, nil
+}
+
+func (p Pinterest) requestReport(ctx context.Context, account_id string, dates DateRange, opts ReportOptions) (string, error) {
+	path := fmt.Sprintf("ad_accounts/%s/reports", account_id)
+	data, err := json.Marshal(reportTemplate.For(dates, opts))
+	if err != nil {
+		return "", err
 	}
-	res.Close()
+	req, err := p.post(ctx, path, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	res, err := p.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Close()
 
-	token := objmap["token"].(string)
-	return token
+	var r struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(res).Decode(&r); err != nil {
+		return "", fmt.Errorf("%w: report token: %v", ErrParse, err)
+	}
+	return r.Token, nil
 }
 
-func (p Pinterest) waitForReport(account_id, token string) string {
-	reportUrl := ""
-	backoff := 1 * time.Second
-	timeout := 60 * time.Second
-	for backoff <= timeout {
-		time.Sleep(backoff)
-		backoff *= 2
+func (p Pinterest) waitForReport(ctx context.Context, account_id, token string) (string, error) {
+	start := time.Now()
+	deadline := start.Add(p.polling.MaxWait)
+	interval := 1 * time.Second
+	for {
+		// Cap the interval itself, not just the wait, so doubling it can't
+		// overflow on long waits.
+		if interval > p.polling.MaxInterval {
+			interval = p.polling.MaxInterval
+		}
+		wait := interval
+		if p.polling.Jitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(p.polling.Jitter)))
+		}
+		if left := time.Until(deadline); wait > left {
+			wait = left
+		}
+		if err := sleep(ctx, wait); err != nil {
+			return "", err
+		}
+		interval *= 2
 
-		s := p.reportStatus(account_id, token)
-		if s.ReportStatus == "FINISHED" {
-			reportUrl = s.URL
-			break
+		s, err := p.reportStatus(ctx, account_id, token)
+		if err != nil {
+			return "", err
+		}
+		switch s.ReportStatus {
+		case "FINISHED":
+			return s.URL, nil
+		case "FAILED", "EXPIRED", "CANCELLED", "DOES_NOT_EXIST":
+			return "", &ReportError{account_id, token, s.ReportStatus, time.Since(start)}
+		}
+		if !time.Now().Before(deadline) {
+			return "", &ReportError{account_id, token, s.ReportStatus, time.Since(start)}
 		}
 	}
-	return reportUrl
 }
 
-func (p Pinterest) getRecords(url string) [][]string {
+func (p Pinterest) getRecords(ctx context.Context, url string) ([][]string, error) {
 	// S3 doesn't require authorization
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	res := p.do(req)
+	res, err := p.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
 	// DEBUG (do not delete; check in to repo)
 	// data, err := io.ReadAll(res)
 	// if err != nil {
@@ -138,7 +309,7 @@ func (p Pinterest) getRecords(url string) [][]string {
 	csvReader := csv.NewReader(res)
 	records, err := csvReader.ReadAll()
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("%w: report CSV: %v", ErrParse, err)
 	}
 
 	// DEBUG (do not delete; check in to repo)
@@ -158,7 +329,88 @@ func (p Pinterest) getRecords(url string) [][]string {
 	// DEBUG (do not delete; check in to repo)
 	// os.Exit(0)
 
-	return records
+	return records, nil
+}
+
+// A Row is a line of a report keyed by the Pinterest column names in the
+// report header, e.g. row["TOTAL_IMPRESSION"].
+type Row map[string]string
+
+// Key each record by the header, which is the first record.  Fail if any of
+// the columns in the mapping is missing from the header so that the metrics
+// are never written to the wrong Airtable fields, or if the report has a
+// granularity (e.g. DAY) and no DATE to say which day each row is for.
+func newRows(records [][]string, granularity string) ([]Row, error) {
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%w: empty report", ErrMissingColumn)
+	}
+	header := records[0]
+	index := make(map[string]int, len(header))
+	for i, name := range header {
+		index[name] = i
+	}
+	columns := mapping.Columns()
+	if granularity != "" && granularity != "TOTAL" {
+		columns = append(columns, "DATE")
+	}
+	for _, name := range columns {
+		if _, ok := index[name]; !ok {
+			return nil, fmt.Errorf("%w: %s", ErrMissingColumn, name)
+		}
+	}
+
+	rows := make([]Row, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(Row, len(header))
+		for name, i := range index {
+			row[name] = record[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// The dates of the row, which are the report's unless it has a granularity
+// (e.g. DAY), in which case they're the row's day, week or month, within the
+// report's dates.
+func (r Row) dates(report DateRange, granularity string) (DateRange, error) {
+	if granularity == "" || granularity == "TOTAL" {
+		return report, nil
+	}
+	d, err := time.Parse(dateLayout, r["DATE"])
+	if err != nil {
+		return DateRange{}, fmt.Errorf("%w: DATE: %v", ErrParse, err)
+	}
+	dates := DateRange{d, d}
+	switch granularity {
+	case "WEEK":
+		dates.End = d.AddDate(0, 0, 6)
+	case "MONTH":
+		dates.End = time.Date(d.Year(), d.Month()+1, 0, 0, 0, 0, 0, time.UTC)
+	}
+	if dates.Start.Before(report.Start) {
+		dates.Start = report.Start
+	}
+	if dates.End.After(report.End) {
+		dates.End = report.End
+	}
+	return dates, nil
+}
+
+func (r Row) atoi(column string) (int, error) {
+	n, err := atoi(r[column])
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", column, err)
+	}
+	return n, nil
+}
+
+func (r Row) parseFloat(column string) (JSONFloat, error) {
+	n, err := parseFloat(r[column])
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", column, err)
+	}
+	return n, nil
 }
 
 type status struct {
@@ -167,18 +419,35 @@ type status struct {
 	Size         int    `json:"size"`
 }
 
-func (p Pinterest) reportStatus(account_id, token string) status {
-	path := fmt.Sprintf("%s/reports?token=%s", account_id, url.QueryEscape(token))
-	req := p.get(path)
-	res := p.do(req)
-
-	dec := json.NewDecoder(res)
+func (p Pinterest) reportStatus(ctx context.Context, account_id, token string) (status, error) {
 	var s status
-	if err := dec.Decode(&s); err != nil {
-		panic(err)
+	path := fmt.Sprintf("ad_accounts/%s/reports?token=%s", account_id, url.QueryEscape(token))
+	req, err := p.get(ctx, path)
+	if err != nil {
+		return s, err
+	}
+	res, err := p.do(req)
+	if err != nil {
+		return s, err
+	}
+	defer res.Close()
+
+	if err := json.NewDecoder(res).Decode(&s); err != nil {
+		return s, fmt.Errorf("%w: report status: %v", ErrParse, err)
+	}
+	return s, nil
+}
+
+// Sleep for d, or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	res.Close()
-	return s
 }
 
 // Write the bytes to a file for inspection.  On GCP, such files will probably
@@ -0,0 +1,198 @@
+package airpin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	backoff := 2 * time.Second
+	tests := []struct {
+		name    string
+		headers map[string]string
+		min     time.Duration
+		max     time.Duration
+	}{
+		{"none", nil, backoff, backoff},
+		{"seconds", map[string]string{"Retry-After": "120"}, 120 * time.Second, 120 * time.Second},
+		{"date", map[string]string{"Retry-After": time.Now().Add(10 * time.Second).UTC().Format(http.TimeFormat)}, 8 * time.Second, 10 * time.Second},
+		{"past date", map[string]string{"Retry-After": time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)}, 0, 0},
+		{"invalid", map[string]string{"Retry-After": "soon"}, backoff, backoff},
+		{"rate limit", map[string]string{"x-ratelimit-remaining": "0", "x-ratelimit-reset": "45"}, 45 * time.Second, 45 * time.Second},
+		{"rate limit left", map[string]string{"x-ratelimit-remaining": "3", "x-ratelimit-reset": "45"}, backoff, backoff},
+		{"both", map[string]string{"Retry-After": "5", "x-ratelimit-remaining": "0", "x-ratelimit-reset": "45"}, 5 * time.Second, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		for k, v := range tt.headers {
+			h.Set(k, v)
+		}
+		if got := retryAfter(h, backoff); got < tt.min || got > tt.max {
+			t.Errorf("%s: retryAfter = %v, want %v to %v", tt.name, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestDoPastDeadline(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	p := NewPinterest("token", Polling{}, Retry{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	_, err = p.do(req)
+	if !errors.Is(err, ErrAPI) {
+		t.Errorf("do = %v, want ErrAPI", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("do waited %v, want it to fail fast", d)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("sent %d requests, want 1", n)
+	}
+}
+
+// A CSV report with the columns in the order of the header, one row per campaign,
+// with every column that isn't in the campaign's values set to "1".
+func csvReport(header []string, campaigns ...map[string]string) [][]string {
+	records := [][]string{header}
+	for _, values := range campaigns {
+		record := make([]string, len(header))
+		for i, column := range header {
+			if v, ok := values[column]; ok {
+				record[i] = v
+			} else {
+				record[i] = "1"
+			}
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestRecordsByHeader(t *testing.T) {
+	columns := mapping.Columns()
+	reversed := make([]string, len(columns))
+	for i, c := range columns {
+		reversed[len(columns)-1-i] = c
+	}
+	// Columns the mapping doesn't read, anywhere in the header, are ignored.
+	extra := append([]string{"AD_ACCOUNT_ID", "DATE"}, columns[len(columns)/2:]...)
+	extra = append(extra, "CAMPAIGN_ENTITY_STATUS")
+	extra = append(extra, columns[:len(columns)/2]...)
+
+	campaign := map[string]string{
+		"CAMPAIGN_ID":      "626744128982",
+		"CAMPAIGN_NAME":    "Spring",
+		"CAMPAIGN_STATUS":  "ACTIVE",
+		"TOTAL_IMPRESSION": "1000",
+		"IMPRESSION_1":     "600",
+		"IMPRESSION_2":     "400",
+		"DATE":             "2024-01-03",
+	}
+	want := map[string]any{
+		"Campaign ID":     "626744128982",
+		"Campaign Name":   "Spring",
+		"Campaign Status": "ACTIVE",
+		"IM":              1000,
+		"IM1":             600,
+		"IM2":             400,
+		"Report Date":     "2024-02-01",
+		"Start":           "2024-01-01",
+		"End":             "2024-01-31",
+	}
+	tests := []struct {
+		name   string
+		header []string
+	}{
+		{"mapping order", columns},
+		{"reversed", reversed},
+		{"other columns", extra},
+	}
+	month := dates("2024-01-01", "2024-01-31")
+	for _, tt := range tests {
+		rows, err := newRows(csvReport(tt.header, campaign), "TOTAL")
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		recs, err := Airtable{}.Records(rows, month, "TOTAL", day("2024-02-01"))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(recs) != 1 {
+			t.Errorf("%s: %d records, want 1", tt.name, len(recs))
+			continue
+		}
+		for field, v := range want {
+			if got := recs[0].Fields[field]; got != v {
+				t.Errorf("%s: %s = %v (%T), want %v (%T)", tt.name, field, got, got, v, v)
+			}
+		}
+	}
+
+	// With a granularity, each row is for its DATE.
+	rows, err := newRows(csvReport(extra, campaign), "WEEK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recs, err := Airtable{}.Records(rows, month, "WEEK", day("2024-02-01"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if start, end := recs[0].Fields["Start"], recs[0].Fields["End"]; start != "2024-01-03" || end != "2024-01-09" {
+		t.Errorf("WEEK: %v to %v, want 2024-01-03 to 2024-01-09", start, end)
+	}
+}
+
+func TestNewRowsMissingColumn(t *testing.T) {
+	columns := mapping.Columns()
+	without := func(column string) []string {
+		var header []string
+		for _, c := range columns {
+			if c != column {
+				header = append(header, c)
+			}
+		}
+		return header
+	}
+	tests := []struct {
+		name        string
+		records     [][]string
+		granularity string
+		missing     string
+	}{
+		{"empty", nil, "TOTAL", "empty report"},
+		{"first", csvReport(without(columns[0])), "TOTAL", columns[0]},
+		{"last", csvReport(without(columns[len(columns)-1]), map[string]string{}), "TOTAL", columns[len(columns)-1]},
+		{"derived", csvReport(without("OUTBOUND_CLICK_2")), "", "OUTBOUND_CLICK_2"},
+		{"date", csvReport(columns), "DAY", "DATE"},
+	}
+	for _, tt := range tests {
+		_, err := newRows(tt.records, tt.granularity)
+		if !errors.Is(err, ErrMissingColumn) {
+			t.Errorf("%s: %v, want ErrMissingColumn", tt.name, err)
+			continue
+		}
+		if !strings.HasSuffix(err.Error(), tt.missing) {
+			t.Errorf("%s: %v, want it to name %s", tt.name, err, tt.missing)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package airpin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Airtable number fields have at most 8 decimal places.
+const maxPrecision = 8
+
+// The Airtable field for f, with its description, so that the abbreviated
+// names explain themselves.  describe returns the description of a Pinterest
+// column.
+func (f Field) tableField(describe func(column string) string) TableField {
+	precision := 2
+	if f.Round != nil {
+		precision = *f.Round
+	}
+	if precision > maxPrecision {
+		precision = maxPrecision
+	}
+	t := TableField{Name: f.Name, Description: f.description(describe)}
+	switch f.Type {
+	case Int:
+		t.Type = "number"
+		t.Options = map[string]any{"precision": 0}
+	case Float:
+		t.Type = "number"
+		t.Options = map[string]any{"precision": precision}
+	case Currency:
+		t.Type = "currency"
+		t.Options = map[string]any{"precision": precision, "symbol": "$"}
+	case Percent:
+		t.Type = "percent"
+		t.Options = map[string]any{"precision": precision}
+	case Date:
+		t.Type = "date"
+		t.Options = map[string]any{"dateFormat": map[string]any{"name": "iso"}}
+	default:
+		t.Type = "singleLineText"
+	}
+	return t
+}
+
+// The description of the column, or the formula and the definitions of the
+// derived metrics in it.
+func (f Field) description(describe func(column string) string) string {
+	if f.Column != "" {
+		if describe == nil {
+			return f.Column
+		}
+		return describe(f.Column)
+	}
+	if f.expr == nil {
+		return ""
+	}
+	lines := []string{"Calculated as " + f.Formula}
+	for _, name := range f.expr.Names() {
+		if d, ok := mapping.Derived[name]; ok {
+			lines = append(lines, fmt.Sprintf("where %s = %s", name, d))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Create the table of the base, or the fields it's missing, with the types
+// Airpin writes.  Fields that exist with the wrong type are left alone and
+// reported as SchemaErrors, since converting them could lose data.  The
+// fields copied from Pinterest columns are described by describe, e.g. with
+// Pinterest's definitions of the columns.  The token needs the
+// schema.bases:write scope.
+func (a Airtable) Provision(ctx context.Context, base Base, describe func(column string) string) error {
+	tables, err := a.Tables(ctx, base.ID)
+	if err != nil {
+		return fmt.Errorf("base %s: %w", base.ID, err)
+	}
+	fields := base.schema()
+	table := findTable(tables, base.Table)
+	if table == nil {
+		t := Table{Name: base.Table}
+		for _, f := range fields {
+			t.Fields = append(t.Fields, f.tableField(describe))
+		}
+		if _, err := a.createTable(ctx, base.ID, t); err != nil {
+			return fmt.Errorf("%s: %w", base.path(), err)
+		}
+		log.Printf("airtable: created %s with %d fields", base.path(), len(t.Fields))
+		return nil
+	}
+
+	existing := make(map[string]bool, len(table.Fields))
+	for _, f := range table.Fields {
+		existing[f.Name] = true
+	}
+	var errs []error
+	for _, f := range fields {
+		if existing[f.Name] {
+			continue
+		}
+		if err := a.createField(ctx, base.ID, table.ID, f.tableField(describe)); err != nil {
+			errs = append(errs, fmt.Errorf("%s: field %q: %w", base.path(), f.Name, err))
+			if ctx.Err() != nil {
+				return errors.Join(errs...)
+			}
+			continue
+		}
+		log.Printf("airtable: created %s field %q", base.path(), f.Name)
+	}
+	for _, err := range checkSchema(base, tables) {
+		var schemaErr *SchemaError
+		if errors.As(err, &schemaErr) && schemaErr.Got != "" {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (a Airtable) createTable(ctx context.Context, id string, table Table) (Table, error) {
+	body, err := json.Marshal(table)
+	if err != nil {
+		return Table{}, err
+	}
+	res, err := a.send(ctx, "POST", id, "meta/bases/"+id+"/tables", nil, body)
+	if err != nil {
+		return Table{}, err
+	}
+	var created Table
+	if err := json.Unmarshal(res, &created); err != nil {
+		return Table{}, fmt.Errorf("%w: %s: %v", ErrParse, table.Name, err)
+	}
+	return created, nil
+}
+
+func (a Airtable) createField(ctx context.Context, id string, table string, field TableField) error {
+	body, err := json.Marshal(field)
+	if err != nil {
+		return err
+	}
+	_, err = a.send(ctx, "POST", id, "meta/bases/"+id+"/tables/"+table+"/fields", nil, body)
+	return err
+}
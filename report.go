@@ -0,0 +1,83 @@
+package airpin
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+)
+
+// The report template, which matches the one in Pinterest (see README.md).
+//
+//go:embed "config.json"
+var cfg []byte
+
+// A ReportRequest is the body of a request for an async report.
+type ReportRequest struct {
+	StartDate              string   `json:"start_date"`
+	EndDate                string   `json:"end_date"`
+	Granularity            string   `json:"granularity"`
+	ClickWindowDays        int      `json:"click_window_days"`
+	EngagementWindowDays   int      `json:"engagement_window_days"`
+	ViewWindowDays         int      `json:"view_window_days"`
+	ConversionReportTime   string   `json:"conversion_report_time"`
+	CampaignStatuses       []string `json:"campaign_statuses"`
+	CampaignObjectiveTypes []string `json:"campaign_objective_types"`
+	Columns                []string `json:"columns"`
+	Level                  string   `json:"level"`
+	ReportFormat           string   `json:"report_format"`
+}
+
+var reportTemplate = newReportRequest(cfg)
+
+// Panic on an invalid template, like the mapping, since it's embedded and
+// must never be deployed.  Every column the mapping reads has to be in the
+// report.
+func newReportRequest(data []byte) ReportRequest {
+	var r ReportRequest
+	if err := json.Unmarshal(data, &r); err != nil {
+		panic("config.json: " + err.Error())
+	}
+	columns := make(map[string]bool, len(r.Columns))
+	for _, c := range r.Columns {
+		columns[c] = true
+	}
+	for _, c := range mapping.Columns() {
+		if !columns[c] {
+			panic("config.json: the mapping reads " + c + " but the report doesn't have it")
+		}
+	}
+	return r
+}
+
+// A copy of the template for the dates with the options, which shares
+// nothing with it, so that requests can be built concurrently.
+func (r ReportRequest) For(dates DateRange, opts ReportOptions) ReportRequest {
+	r.StartDate = dates.Start.Format(dateLayout)
+	r.EndDate = dates.End.Format(dateLayout)
+	if opts.Granularity != "" {
+		r.Granularity = opts.Granularity
+	}
+	r.CampaignStatuses = append([]string(nil), r.CampaignStatuses...)
+	r.CampaignObjectiveTypes = append([]string(nil), r.CampaignObjectiveTypes...)
+	r.Columns = append([]string(nil), r.Columns...)
+	return r
+}
+
+// The longest date range Pinterest will report on in one request.
+const maxReportDays = 186
+
+// ReportOptions override the granularity of the report template in
+// config.json; empty options keep the template's.  With a granularity other
+// than TOTAL, each row is for a day, week or month of the report's dates.
+type ReportOptions struct {
+	Granularity string `json:"granularity,omitempty"`
+}
+
+func (o ReportOptions) validate() error {
+	switch o.Granularity {
+	case "", "TOTAL", "DAY", "WEEK", "MONTH":
+	default:
+		return fmt.Errorf("%w: invalid granularity %q", ErrParse, o.Granularity)
+	}
+	return nil
+}
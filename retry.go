@@ -0,0 +1,87 @@
+package airpin
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Retry controls how many times a failed request is attempted and how long to
+// back off between attempts.  The backoff doubles after each attempt up to
+// MaxBackoff.  The environment variables are prefixed with the name of the
+// API, e.g. AIRTABLE_RETRY_ATTEMPTS.
+type Retry struct {
+	Attempts   int           `env:"RETRY_ATTEMPTS" envDefault:"5"`
+	Backoff    time.Duration `env:"RETRY_BACKOFF" envDefault:"1s"`
+	MaxBackoff time.Duration `env:"RETRY_MAX_BACKOFF" envDefault:"30s"`
+}
+
+// The backoff before the given attempt, counting from 1.
+func (r Retry) backoff(attempt int) time.Duration {
+	d := r.Backoff
+	for i := 1; i < attempt && d < r.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.MaxBackoff {
+		d = r.MaxBackoff
+	}
+	return d
+}
+
+// A limiter is a token bucket for each key (e.g. an Airtable base) which
+// allows rate requests per second, in bursts of up to rate.
+type limiter struct {
+	rate    float64
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate float64) *limiter {
+	return &limiter{rate: rate, buckets: map[string]*bucket{}}
+}
+
+// The bucket for the key, refilled up to now.  l.mu must be held.
+func (l *limiter) refill(key string, now time.Time) *bucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{l.rate, now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.rate {
+		b.tokens = l.rate
+	}
+	b.last = now
+	return b
+}
+
+// Wait until a request for the key is allowed, or the context is done.
+func (l *limiter) wait(ctx context.Context, key string) error {
+	l.mu.Lock()
+	b := l.refill(key, time.Now())
+	// Take the token now, even if it's not there yet, so that concurrent
+	// callers queue up behind each other.
+	b.tokens--
+	var d time.Duration
+	if b.tokens < 0 {
+		d = time.Duration(-b.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	return sleep(ctx, d)
+}
+
+// Hold off all requests for the key for d, e.g. when the API says we've sent
+// too many.
+func (l *limiter) penalize(key string, d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.refill(key, time.Now())
+	if t := 1 - d.Seconds()*l.rate; t < b.tokens {
+		b.tokens = t
+	}
+}
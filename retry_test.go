@@ -0,0 +1,67 @@
+package airpin
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	r := Retry{Attempts: 5, Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		if got := r.backoff(i + 1); got != w {
+			t.Errorf("backoff(%d) = %v, want %v", i+1, got, w)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(10)
+	ctx := context.Background()
+
+	// A burst of up to the rate doesn't wait.
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := l.wait(ctx, "appA"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("burst waited %v", d)
+	}
+
+	// The next one waits for a token.
+	start = time.Now()
+	if err := l.wait(ctx, "appA"); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Errorf("waited %v after the burst, want about 100ms", d)
+	}
+
+	// A penalty holds off the key, but not the others.
+	l.penalize("appA", 300*time.Millisecond)
+	start = time.Now()
+	if err := l.wait(ctx, "appB"); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("another key waited %v", d)
+	}
+	start = time.Now()
+	if err := l.wait(ctx, "appA"); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 250*time.Millisecond {
+		t.Errorf("waited %v after the penalty, want about 300ms", d)
+	}
+
+	// Waiting stops when the context is done.
+	l.penalize("appA", time.Hour)
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if err := l.wait(ctx, "appA"); err != context.DeadlineExceeded {
+		t.Errorf("wait during a penalty = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,518 @@
+package airpin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Run is what the Pub/Sub message asks for.  Period picks the clients and
+// tables to run, and the dates, unless Dates is set.  With Backfill, Dates is
+// split into periods (e.g. calendar months), each written as its own rows;
+// otherwise it's written as one row per campaign.  Ranges longer than
+// Pinterest allows (e.g. year-to-date in the autumn) are split as little as
+// possible.  Calendar weeks start on WeekStart.  Accounts, if any, are the
+// only clients to run, whether or not they're scheduled for the period.
+// DryRun fetches and maps the reports, then renders the exact requests that
+// would write them to Airtable instead of sending them.  Clock is what the
+// dates are relative to.
+type Run struct {
+	Period    Period
+	Dates     *DateRange
+	Backfill  bool
+	WeekStart time.Weekday
+	Accounts  []string
+	DryRun    bool
+	Report    ReportOptions
+	Clock     Clock
+}
+
+// RunOptions are what a run is asked to do, e.g. by the JSON Pub/Sub message
+// or the command line.  Start and End are dates, e.g. "2024-01-01".
+type RunOptions struct {
+	Period   Period   `json:"period"`
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	Backfill bool     `json:"backfill"`
+	Accounts []string `json:"accounts"`
+	DryRun   bool     `json:"dry_run"`
+	ReportOptions
+}
+
+// The run the options ask for, once they've been validated.
+func (o RunOptions) Run() (Run, error) {
+	if err := o.ReportOptions.validate(); err != nil {
+		return Run{}, err
+	}
+	run := Run{
+		Period:   o.Period,
+		Backfill: o.Backfill,
+		Accounts: o.Accounts,
+		DryRun:   o.DryRun,
+		Report:   o.ReportOptions,
+	}
+	if o.Start != "" || o.End != "" {
+		dates, err := parseDateRange(o.Start, o.End)
+		if err != nil {
+			return Run{}, err
+		}
+		run.Dates = &dates
+	} else if o.Backfill {
+		return Run{}, fmt.Errorf("%w: backfill needs a start and end", ErrParse)
+	}
+	return run, nil
+}
+
+// Apply the configuration's week start and dry run to the run.
+func (r *Run) Configure(conf Config) error {
+	weekStart, err := parseWeekday(conf.WeekStart)
+	if err != nil {
+		return err
+	}
+	r.WeekStart = weekStart
+	r.DryRun = r.DryRun || conf.DryRun
+	return nil
+}
+
+// Whether the client is run.
+func (r Run) selects(c Client, period Period) bool {
+	if len(r.Accounts) == 0 {
+		return c.scheduled(period)
+	}
+	for _, a := range r.Accounts {
+		if a == c.AccountID {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that the accounts asked for are enabled clients, so that a typo
+// isn't a run that does nothing.
+func (r Run) checkAccounts(enabled []Client) error {
+	var errs []error
+	for _, a := range r.Accounts {
+		found := false
+		for _, c := range enabled {
+			found = found || c.AccountID == a
+		}
+		if !found {
+			errs = append(errs, fmt.Errorf("account %s is not an enabled client", a))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// The date ranges to fetch, given the time in the account's timezone.
+func (r Run) Ranges(now time.Time) []DateRange {
+	var ranges []DateRange
+	switch {
+	case r.Dates == nil:
+		ranges = []DateRange{r.Period.Range(now, r.WeekStart)}
+	case r.Backfill:
+		ranges = r.Dates.Split(r.Period, r.WeekStart)
+	default:
+		ranges = []DateRange{*r.Dates}
+	}
+	var chunks []DateRange
+	for _, dates := range ranges {
+		chunks = append(chunks, dates.Chunk(maxReportDays)...)
+	}
+	return chunks
+}
+
+// An AccountResult is what a run did with an ad account: the reports and rows
+// fetched, the rows written to all of its tables, and how long it took to
+// fetch.
+type AccountResult struct {
+	Account string  `json:"account"`
+	Reports int     `json:"reports"`
+	Rows    int     `json:"rows"`
+	Written int     `json:"written"`
+	Seconds float64 `json:"seconds"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// A BaseResult is what a run wrote to a table.
+type BaseResult struct {
+	Table    string   `json:"table"`
+	Accounts []string `json:"accounts"`
+	Records  int      `json:"records"`
+	Written  int      `json:"written"`
+	Seconds  float64  `json:"seconds"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// A Summary is what a run did, which is logged as JSON at the end so that
+// runs can be monitored.  Failed lists the accounts with errors.
+type Summary struct {
+	Period           Period          `json:"period"`
+	DryRun           bool            `json:"dry_run,omitempty"`
+	Accounts         []AccountResult `json:"accounts"`
+	Bases            []BaseResult    `json:"bases"`
+	Failed           []string        `json:"failed,omitempty"`
+	PinterestRetries int64           `json:"pinterest_retries"`
+	AirtableRetries  int64           `json:"airtable_retries"`
+	Seconds          float64         `json:"seconds"`
+	Error            string          `json:"error,omitempty"`
+}
+
+func (s Summary) log() {
+	data, err := json.Marshal(s)
+	if err != nil {
+		log.Printf("summary: %v", err)
+		return
+	}
+	log.Printf("summary: %s", data)
+}
+
+// Do the run with the configuration.  Every account's reports are requested
+// up front and downloaded concurrently, then the tables are written
+// concurrently.  Each account is on its own: one that fails (e.g. its access
+// was revoked, or its table is missing) doesn't stop the others from being
+// written, and the error lists every account and table that failed.
+func (r Run) Do(ctx context.Context, conf Config) (summary Summary, err error) {
+	start := time.Now()
+	summary = Summary{Period: r.Period, DryRun: r.DryRun}
+	pin := NewPinterest(conf.PinterestToken, conf.Polling, conf.PinterestRetry)
+	air := NewAirtable(conf.AirtableToken, conf.AirtableRetry)
+	defer func() {
+		for _, a := range summary.Accounts {
+			if a.Error != "" {
+				summary.Failed = append(summary.Failed, a.Account)
+			}
+		}
+		summary.PinterestRetries = pin.Retries()
+		summary.AirtableRetries = air.Retries()
+		summary.Seconds = time.Since(start).Seconds()
+		if err != nil {
+			summary.Error = err.Error()
+		}
+	}()
+	clients, err := LoadClients(ctx, conf.Clients, air)
+	if err != nil {
+		return summary, err
+	}
+
+	// Tables are shared if any enabled client writes to them, whether or not
+	// it's run for this period, so that their rows always have the same
+	// fields.
+	var enabled, active []Client
+	for _, c := range clients {
+		if c.enabled() {
+			enabled = append(enabled, c)
+			if r.selects(c, r.Period) {
+				active = append(active, c)
+			}
+		}
+	}
+	if err := r.checkAccounts(enabled); err != nil {
+		return summary, err
+	}
+	routes := route(enabled, r.Period)
+	bases := map[string]Base{}
+	var targets []Base
+	for _, c := range active {
+		for _, base := range routes[c.AccountID] {
+			if _, ok := bases[base.path()]; !ok {
+				bases[base.path()] = base
+				targets = append(targets, base)
+			}
+		}
+	}
+
+	// Tables that fail the preflight aren't written, and accounts with no
+	// other tables aren't fetched.
+	var errs []error
+	failed := map[string]error{}
+	if conf.Preflight {
+		for i, err := range air.preflight(ctx, targets) {
+			if err != nil {
+				failed[targets[i].path()] = err
+				errs = append(errs, err)
+			}
+		}
+	}
+	var fetching []Client
+	for _, c := range active {
+		writable := false
+		for _, base := range routes[c.AccountID] {
+			writable = writable || failed[base.path()] == nil
+		}
+		if writable {
+			fetching = append(fetching, c)
+			continue
+		}
+		err := fmt.Errorf("account %s: none of its tables can be written", c.AccountID)
+		summary.Accounts = append(summary.Accounts, AccountResult{Account: c.AccountID, Error: err.Error()})
+		errs = append(errs, err)
+	}
+
+	// Bad data never reaches Airtable: an account is only written if all of
+	// its reports were fetched and mapped.
+	fetches := r.fetch(ctx, pin, air, fetching, conf.Concurrency)
+	writes := map[string][]write{}
+	for i, f := range fetches {
+		if f.err != nil {
+			errs = append(errs, fmt.Errorf("account %s: %w", f.client.AccountID, f.err))
+			continue
+		}
+		for _, base := range routes[f.client.AccountID] {
+			if failed[base.path()] != nil {
+				continue
+			}
+			out := f.recs
+			if base.AccountFields {
+				out = withAccount(f.recs, f.account)
+			}
+			writes[base.path()] = append(writes[base.path()], write{fetch: i, recs: out})
+		}
+	}
+	summary.Bases = make([]BaseResult, len(targets))
+	for i, base := range targets {
+		b := &summary.Bases[i]
+		b.Table = base.path()
+		if err := failed[b.Table]; err != nil {
+			b.Error = err.Error()
+		}
+		for _, w := range writes[b.Table] {
+			b.Accounts = append(b.Accounts, fetches[w.fetch].client.AccountID)
+			b.Records += len(w.recs)
+		}
+	}
+	if r.DryRun {
+		for i, base := range targets {
+			b := &summary.Bases[i]
+			if b.Error != "" {
+				continue
+			}
+			log.Printf("dry run: %d records for %s (accounts %s)", b.Records, b.Table, strings.Join(b.Accounts, ", "))
+			// Each account is rendered on its own, as it would be written.
+			for _, w := range writes[b.Table] {
+				var err error
+				if conf.DryRunDir != "" {
+					err = air.RenderFiles(conf.DryRunDir, base, fetches[w.fetch].client.AccountID, w.recs)
+				} else {
+					err = air.Render(os.Stdout, base, w.recs)
+				}
+				if err != nil {
+					b.Error = err.Error()
+					errs = append(errs, fmt.Errorf("%s: %w", b.Table, err))
+					break
+				}
+			}
+		}
+		for _, f := range fetches {
+			summary.Accounts = append(summary.Accounts, f.result(0, nil))
+		}
+		return summary, errors.Join(errs...)
+	}
+
+	// Each account is written to each table on its own, so that its result
+	// doesn't depend on the others'.
+	parallel(len(targets), conf.WriteConcurrency, func(i int) {
+		base, began := targets[i], time.Now()
+		ws := writes[base.path()]
+		var berrs []error
+		for k := range ws {
+			w := &ws[k]
+			err := air.Write(ctx, base, w.recs)
+			w.written = len(w.recs) - unwritten(err, len(w.recs))
+			summary.Bases[i].Written += w.written
+			if err != nil {
+				w.err = fmt.Errorf("%s: %w", base.path(), err)
+				berrs = append(berrs, w.err)
+			}
+		}
+		if err := errors.Join(berrs...); err != nil {
+			summary.Bases[i].Error = err.Error()
+		}
+		summary.Bases[i].Seconds = time.Since(began).Seconds()
+	})
+
+	results, werrs := accountResults(fetches, targets, writes)
+	summary.Accounts = append(summary.Accounts, results...)
+	return summary, errors.Join(append(errs, werrs...)...)
+}
+
+// A write is an account's records for a table, and what came of writing them.
+type write struct {
+	fetch   int
+	recs    []record
+	written int
+	err     error
+}
+
+// The result of each fetched account, with the rows written to all of its
+// tables, and the errors of the accounts that weren't all written.
+func accountResults(fetches []accountFetch, targets []Base, writes map[string][]write) ([]AccountResult, []error) {
+	results := make([]AccountResult, 0, len(fetches))
+	var errs []error
+	for i, f := range fetches {
+		n := 0
+		var ferrs []error
+		for _, base := range targets {
+			for _, w := range writes[base.path()] {
+				if w.fetch == i {
+					n += w.written
+					ferrs = append(ferrs, w.err)
+				}
+			}
+		}
+		ferr := errors.Join(ferrs...)
+		if ferr != nil {
+			errs = append(errs, fmt.Errorf("account %s: %w", f.client.AccountID, ferr))
+		}
+		results = append(results, f.result(n, ferr))
+	}
+	return results, errs
+}
+
+// The number of the n records that weren't written because of the error from
+// Airtable.Write, which are every one of them unless it's only BatchErrors.
+func unwritten(err error, n int) int {
+	if err == nil {
+		return 0
+	}
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		var batchErr *BatchError
+		if errors.As(err, &batchErr) {
+			return len(batchErr.CampaignIDs)
+		}
+		return n
+	}
+	count := 0
+	for _, e := range joined.Unwrap() {
+		var batchErr *BatchError
+		if !errors.As(e, &batchErr) {
+			return n
+		}
+		count += len(batchErr.CampaignIDs)
+	}
+	return count
+}
+
+// An accountFetch is an account's reports, from requesting them to mapping
+// their rows to records.
+type accountFetch struct {
+	client  Client
+	account AdAccount
+	today   time.Time
+	started time.Time
+	reports []report
+	recs    []record
+	err     error
+}
+
+type report struct {
+	dates DateRange
+	token string
+	rows  []Row
+	done  time.Time
+	err   error
+}
+
+// The account's result, with the rows written and the error writing them.
+func (f accountFetch) result(written int, writeErr error) AccountResult {
+	res := AccountResult{Account: f.client.AccountID, Reports: len(f.reports), Rows: len(f.recs), Written: written}
+	for _, rep := range f.reports {
+		if d := rep.done.Sub(f.started).Seconds(); d > res.Seconds {
+			res.Seconds = d
+		}
+	}
+	if err := errors.Join(f.err, writeErr); err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// Request every report of the clients, then wait for and download them, at
+// most concurrency at a time, and map their rows to records.
+func (r Run) fetch(ctx context.Context, pin *Pinterest, air *Airtable, clients []Client, concurrency int) []accountFetch {
+	fetches := make([]accountFetch, len(clients))
+	parallel(len(clients), concurrency, func(i int) {
+		f := &fetches[i]
+		f.client, f.started = clients[i], time.Now()
+		if f.account, f.err = pin.AdAccount(ctx, f.client.AccountID); f.err != nil {
+			return
+		}
+		// Pinterest reports in the account's timezone, so its days are
+		// what "today" and "yesterday" mean.
+		loc, err := f.client.location(f.account)
+		if err != nil {
+			f.err = err
+			return
+		}
+		f.today = r.Clock.Now().In(loc)
+		for _, dates := range r.Ranges(f.today) {
+			token, err := pin.requestReport(ctx, f.client.AccountID, dates, r.Report)
+			if err != nil {
+				f.err = fmt.Errorf("%s: %w", dates, err)
+				return
+			}
+			f.reports = append(f.reports, report{dates: dates, token: token})
+		}
+	})
+
+	type job struct{ fetch, report int }
+	var jobs []job
+	for i, f := range fetches {
+		if f.err == nil {
+			for j := range f.reports {
+				jobs = append(jobs, job{i, j})
+			}
+		}
+	}
+	parallel(len(jobs), concurrency, func(n int) {
+		f := &fetches[jobs[n].fetch]
+		rep := &f.reports[jobs[n].report]
+		rep.rows, rep.err = pin.report(ctx, f.client.AccountID, rep.token, r.Report.Granularity)
+		rep.done = time.Now()
+	})
+
+	for i := range fetches {
+		f := &fetches[i]
+		for _, rep := range f.reports {
+			if f.err != nil {
+				break
+			}
+			if rep.err != nil {
+				f.err = fmt.Errorf("%s: %w", rep.dates, rep.err)
+				break
+			}
+			recs, err := air.Records(rep.rows, rep.dates, r.Report.Granularity, f.today)
+			if err != nil {
+				f.err = fmt.Errorf("%s: %w", rep.dates, err)
+				break
+			}
+			f.recs = append(f.recs, recs...)
+		}
+	}
+	return fetches
+}
+
+// Call f with 0 to n-1, at most limit at a time, and wait for them all.
+func parallel(n, limit int, f func(i int)) {
+	if limit < 1 {
+		limit = 1
+	}
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			f(i)
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,94 @@
+package airpin
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// A batch error for n campaigns.
+func batchError(n int) *BatchError {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprint(i)
+	}
+	return &BatchError{ids, errors.New("500 Internal Server Error")}
+}
+
+func TestUnwritten(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"none", nil, 0},
+		{"one batch", errors.Join(batchError(10)), 10},
+		{"batches", errors.Join(batchError(10), batchError(3)), 13},
+		{"bare batch", batchError(4), 4},
+		{"batches and another error", errors.Join(batchError(10), errors.New("invalid JSON")), 25},
+		{"another error", errors.New("invalid JSON"), 25},
+	}
+	for _, tt := range tests {
+		if got := unwritten(tt.err, 25); got != tt.want {
+			t.Errorf("%s: unwritten = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAccountResults(t *testing.T) {
+	recs := func(n int) []record { return make([]record, n) }
+	fetches := []accountFetch{
+		{client: Client{AccountID: "1"}, recs: recs(25)},
+		{client: Client{AccountID: "2"}, recs: recs(12)},
+		{client: Client{AccountID: "3"}, recs: recs(4)},
+	}
+	targets := []Base{{ID: "appA", Table: "Ad KPIs"}, {ID: "appAgency", Table: "All KPIs"}}
+
+	// As Run.Do records them: account 1 loses two batches in its own table,
+	// account 2 fails outright in the shared one.
+	result := func(fetch int, err error) write {
+		n := len(fetches[fetch].recs)
+		w := write{fetch: fetch, recs: fetches[fetch].recs, written: n - unwritten(err, n)}
+		if err != nil {
+			w.err = fmt.Errorf("table: %w", err)
+		}
+		return w
+	}
+	writes := map[string][]write{
+		"appA/Ad KPIs": {
+			result(0, errors.Join(batchError(10), batchError(3))),
+		},
+		"appAgency/All KPIs": {
+			result(0, nil),
+			result(1, errors.Join(batchError(10), errors.New("invalid JSON"))),
+			result(2, nil),
+		},
+	}
+
+	results, errs := accountResults(fetches, targets, writes)
+	want := []struct {
+		written int
+		failed  bool
+	}{
+		{12 + 25, true},
+		{0, true},
+		{4, false},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("%d results, want %d", len(results), len(want))
+	}
+	for i, w := range want {
+		r := results[i]
+		if r.Account != fetches[i].client.AccountID || r.Rows != len(fetches[i].recs) || r.Written != w.written || (r.Error != "") != w.failed {
+			t.Errorf("account %s: %+v, want %d rows written and failed %v", fetches[i].client.AccountID, r, w.written, w.failed)
+		}
+	}
+	if len(errs) != 2 || !strings.HasPrefix(errs[0].Error(), "account 1: ") || !strings.HasPrefix(errs[1].Error(), "account 2: ") {
+		t.Errorf("errors = %v, want accounts 1 and 2", errs)
+	}
+	var batchErr *BatchError
+	if !errors.As(errs[0], &batchErr) {
+		t.Errorf("%v doesn't wrap the BatchErrors", errs[0])
+	}
+}
@@ -0,0 +1,150 @@
+package airpin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// A Table is the schema of an Airtable table, from the Meta API.
+type Table struct {
+	ID     string       `json:"id"`
+	Name   string       `json:"name"`
+	Fields []TableField `json:"fields"`
+}
+
+type TableField struct {
+	ID          string         `json:"id,omitempty"`
+	Name        string         `json:"name"`
+	Type        string         `json:"type"`
+	Description string         `json:"description,omitempty"`
+	Options     map[string]any `json:"options,omitempty"`
+}
+
+// The Airtable field types that a value of each type can be written to, with
+// typecasting, starting with the type Airpin provisions it as.  Numbers can go
+// in any number field, strings in any text field or a select, and dates, which
+// were written as text before, in a text field too.
+var airtableTypes = map[FieldType][]string{
+	Int:      {"number", "currency", "percent"},
+	Float:    {"number", "currency", "percent"},
+	Currency: {"currency", "number", "percent"},
+	Percent:  {"percent", "number", "currency"},
+	String:   {"singleLineText", "multilineText", "richText", "singleSelect"},
+	Date:     {"date", "dateTime", "singleLineText", "multilineText"},
+}
+
+// The fields that Airpin writes to the table of the base, named as they are
+// in the table.
+func (b Base) schema() []Field {
+	fields := make([]Field, 0, len(mapping.Fields)+5)
+	for _, f := range mapping.Fields {
+		f.Name = b.field(f.Name)
+		fields = append(fields, f)
+	}
+	for _, name := range []string{"Report Date", "Start", "End"} {
+		fields = append(fields, Field{Name: b.field(name), Type: Date})
+	}
+	if b.AccountFields {
+		for _, name := range []string{accountIdField, accountNameField} {
+			fields = append(fields, Field{Name: b.field(name), Type: String})
+		}
+	}
+	return fields
+}
+
+// The schema of every table in the base.
+func (a Airtable) Tables(ctx context.Context, id string) ([]Table, error) {
+	body, err := a.send(ctx, "GET", id, "meta/bases/"+id+"/tables", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Tables []Table `json:"tables"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, fmt.Errorf("%w: %s tables: %v", ErrParse, id, err)
+	}
+	return res.Tables, nil
+}
+
+// Check that the table of each base has every field Airpin writes, with a
+// type that can hold it.  A field of another type than Airpin would create,
+// e.g. a number field for a currency, is only logged as a warning.  Every
+// mismatch in every base is reported, as a SchemaError, so that they can all
+// be fixed before the next run.  The token needs the schema.bases:read scope.
+func (a Airtable) Preflight(ctx context.Context, bases []Base) error {
+	return errors.Join(a.preflight(ctx, bases)...)
+}
+
+// The mismatches of each base, in the same order, or nil if it has none.
+func (a Airtable) preflight(ctx context.Context, bases []Base) []error {
+	tables := map[string][]Table{}
+	errs := make([]error, len(bases))
+	for i, base := range bases {
+		ts, ok := tables[base.ID]
+		if !ok {
+			var err error
+			if ts, err = a.Tables(ctx, base.ID); err != nil {
+				errs[i] = fmt.Errorf("base %s: %w", base.ID, err)
+				continue
+			}
+			tables[base.ID] = ts
+		}
+		errs[i] = errors.Join(checkSchema(base, ts)...)
+	}
+	return errs
+}
+
+// The mismatches between the table of the base and the fields Airpin writes.
+func checkSchema(base Base, tables []Table) []error {
+	table := findTable(tables, base.Table)
+	if table == nil {
+		return []error{&SchemaError{Table: base.path()}}
+	}
+	types := make(map[string]string, len(table.Fields))
+	for _, f := range table.Fields {
+		types[f.Name] = f.Type
+	}
+
+	var errs []error
+	for _, f := range base.schema() {
+		got, ok := types[f.Name]
+		if !ok {
+			errs = append(errs, &SchemaError{base.path(), f.Name, f.Type, ""})
+			continue
+		}
+		allowed := airtableTypes[f.Type]
+		switch {
+		case got == allowed[0]:
+		case contains(allowed, got):
+			// It can be written, but e.g. a percent in a number field
+			// isn't displayed as one.
+			log.Printf("airtable: warning: %s: field %q is %s, not %s", base.path(), f.Name, got, allowed[0])
+		default:
+			errs = append(errs, &SchemaError{base.path(), f.Name, f.Type, got})
+		}
+	}
+	return errs
+}
+
+// The table with the name (or ID), or nil if there isn't one.
+func findTable(tables []Table, name string) *Table {
+	for i := range tables {
+		if tables[i].Name == name || tables[i].ID == name {
+			return &tables[i]
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -2,7 +2,9 @@
 #
 # NB: Set credentials by sourcing `creds.sh` first.
 
-# Build and serve the function locally.
+# Build and serve the function locally.  The clients are read from
+# `clients.json` unless CLIENTS says otherwise.
+export CLIENTS=${CLIENTS:-../clients.json}
 pushd cmd
 go build
 ./cmd >../cmd_stdout.log 2>../cmd_stderr.log & 
@@ -10,9 +12,12 @@ pid=$!
 sleep 2
 echo "Serving function with PID $pid."
 
-# Send a CloudEvent to the locally running function:
+# Send a CloudEvent to the locally running function.  MESSAGE is the Pub/Sub
+# message, e.g. "month" or a backfill like
+# '{"period": "month", "start": "2024-01-01", "end": "2024-06-30", "backfill": true}'
 # "7-day" base64-encoded is "Ny1kYXk="
 # "month" base64-encoded is "bW9udGg="
+data=$(printf '%s' "${MESSAGE:-7-day}" | base64 | tr -d '\n')
 curl localhost:8080/airpin \
   -X POST \
   -H "Content-Type: application/json" \
@@ -23,7 +28,7 @@ curl localhost:8080/airpin \
   -H "ce-source: //pubsub.googleapis.com/projects/complete-road-241116/topics/airpin" \
   -d '{
         "message": {
-          "data": "Ny1kYXk="
+          "data": "'"$data"'"
         },
         "subscription": "projects/complete-road-241116/subscriptions/airpin"
       }'